@@ -0,0 +1,38 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+)
+
+// Aliases are additional spoken names of ZWay devices and locations
+type Aliases struct {
+	// ZWay device ID -> names
+	Devices map[string][]string `json:"devices"`
+	// ZWay location ID -> names
+	Locations map[string][]string `json:"locations"`
+	// ZWay device tag -> names
+	Tags map[string][]string `json:"tags"`
+}
+
+func LoadAliases(fileName string) (*Aliases, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	aliases := &Aliases{}
+	if err = json.NewDecoder(f).Decode(aliases); err != nil {
+		return nil, fmt.Errorf("Can't parse '%s': %s", fileName, err.Error())
+	}
+
+	for id := range aliases.Locations {
+		if _, err := strconv.Atoi(id); err != nil {
+			return nil, fmt.Errorf("Invalid location ID '%s' in '%s'", id, fileName)
+		}
+	}
+	return aliases, nil
+}
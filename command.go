@@ -3,7 +3,10 @@ package main
 import (
 	"bytes"
 	"log"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 	"unicode"
 	"unicode/utf8"
@@ -19,6 +22,17 @@ const (
 	CommandDimmerUp
 	CommandDimmerDown
 	CommandDimmerMax
+	CommandDimmerLevel
+	CommandThermostatUp
+	CommandThermostatDown
+	CommandThermostatLevel
+	CommandQuery
+	CommandChoose
+	CommandUndo
+	CommandScene
+	CommandReset
+	// Absolute level for devices of any type. It is replaced by dimmer or thermostat level, when devices are resolved
+	CommandLevel
 )
 
 type CommandDef struct {
@@ -32,14 +46,36 @@ type CommandDataRGB struct {
 	R, G, B int
 }
 
-var commands = [...]CommandDef{
+type CommandDataLevel struct {
+	Level int
+}
+
+// Device types, which accept absolute level parsed from phrase digits
+var dimmerDevTypes = []string{"switchMultilevel"}
+var thermostatDevTypes = []string{"thermostat"}
+var levelDevTypes = append(append([]string{}, dimmerDevTypes...), thermostatDevTypes...)
+
+// Absolute level is number with unit, e.g. "40%", "22 градуса", or after preposition, e.g. "to 40", "на 40".
+// Number of title, e.g. "лампа 2", or duration, e.g. "на 20 минут", isn't level
+var reLevel = regexp.MustCompile(`(?:^|\s)(to|на|до)?\s*(\d+)(?:\s*(%|процент\pL*|percents?|градус\pL*|degrees?|°|` +
+	`секунд\pL*|сек|seconds?|secs?|минут\pL*|мин|minutes?|mins?|час\pL*|hours?))?`)
+
+// Built-in commands vocabulary. Can be replaced by file, passed with -commands flag
+var commands = []CommandDef{
 	{"run", []string{"toggleButton"}, CommandOn, nil},
 	{"on", []string{"*"}, CommandOn, nil},
 	{"off", []string{"*"}, CommandOff, nil},
+	{"undo", []string{"*"}, CommandUndo, nil},
+	{"forget", []string{"*"}, CommandReset, nil},
+	{"reset", []string{"*"}, CommandReset, nil},
 
 	{"ligher", []string{"switchMultilevel"}, CommandDimmerUp, nil},
 	{"darker", []string{"switchMultilevel"}, CommandDimmerDown, nil},
 	{"maximum", []string{"switchMultilevel"}, CommandDimmerMax, nil},
+	{"half", []string{"switchMultilevel"}, CommandDimmerLevel, CommandDataLevel{50}},
+
+	{"warmer", []string{"thermostat"}, CommandThermostatUp, nil},
+	{"colder", []string{"thermostat"}, CommandThermostatDown, nil},
 
 	{"red", []string{"switchRGBW"}, CommandRGB, CommandDataRGB{100, 0, 0}},
 	{"dark blue", []string{"switchRGBW"}, CommandRGB, CommandDataRGB{0, 0, 100}},
@@ -55,14 +91,23 @@ var commands = [...]CommandDef{
 	{"погаси", []string{"*"}, CommandOff, nil},
 	{"отключи", []string{"*"}, CommandOff, nil},
 	{"выключи", []string{"*"}, CommandOff, nil},
+	{"отмена", []string{"*"}, CommandUndo, nil},
+	{"отмени", []string{"*"}, CommandUndo, nil},
+	{"забудь", []string{"*"}, CommandReset, nil},
 
 	{"ярче", []string{"switchMultilevel"}, CommandDimmerUp, nil},
 	{"светлее", []string{"switchMultilevel"}, CommandDimmerUp, nil},
 	{"темнее", []string{"switchMultilevel"}, CommandDimmerDown, nil},
 	{"максимум", []string{"switchMultilevel"}, CommandDimmerMax, nil},
+	{"половину", []string{"switchMultilevel"}, CommandDimmerLevel, CommandDataLevel{50}},
+	{"наполовину", []string{"switchMultilevel"}, CommandDimmerLevel, CommandDataLevel{50}},
 	{"больше", []string{"switchMultilevel"}, CommandDimmerUp, nil},
 	{"меньше", []string{"switchMultilevel"}, CommandDimmerDown, nil},
 
+	{"теплее", []string{"thermostat"}, CommandThermostatUp, nil},
+	{"холоднее", []string{"thermostat"}, CommandThermostatDown, nil},
+	{"прохладнее", []string{"thermostat"}, CommandThermostatDown, nil},
+
 	{"красный", []string{"switchRGBW"}, CommandRGB, CommandDataRGB{100, 0, 0}},
 	{"синий", []string{"switchRGBW"}, CommandRGB, CommandDataRGB{0, 0, 100}},
 	{"зеленый", []string{"switchRGBW"}, CommandRGB, CommandDataRGB{0, 100, 0}},
@@ -72,13 +117,73 @@ var commands = [...]CommandDef{
 	{"фиолетовый", []string{"switchRGBW"}, CommandRGB, CommandDataRGB{100, 0, 100}},
 }
 
+var clauseSeparators = map[string]bool{
+	",": true, ";": true,
+	"and": true, "then": true,
+	"и": true, "потом": true, "затем": true,
+}
+
+// Device types, which can be only queried, but not controlled
+var sensorDevTypes = []string{"sensorMultilevel", "sensorBinary"}
+
+// Spoken names of sensors by ZWay probe type
+var sensorProbeNames = map[string][]string{
+	"temperature":     {"температура", "temperature"},
+	"humidity":        {"влажность", "humidity"},
+	"luminosity":      {"освещенность", "luminance"},
+	"motion":          {"движение", "motion"},
+	"door-window":     {"дверь", "окно", "door", "window"},
+	"general_purpose": {"датчик", "sensor"},
+}
+
+// Command for questions about device state, e.g. "is the light in the kitchen on?"
+var queryCommand = CommandDef{"состояние", []string{"*"}, CommandQuery, nil}
+
+// Command for clarification, which of several devices with the same score to use
+var chooseCommand = CommandDef{"уточнение", []string{"*"}, CommandChoose, nil}
+
+// Words, which make phrase a question. English words are checked only at beginning of phrase
+var questionWords = []string{"ли", "какой", "какая", "какое", "каков", "сколько"}
+var questionStartWords = []string{"is", "are", "what", "which", "how"}
+
+// Words, which separate excluded devices, e.g. "turn off everything except the fridge"
+var exceptSeparators = []string{"except", "but not", "кроме", "за исключением"}
+
+// Words, which select all devices in location
+var allWords = []string{"all", "everything", "все", "всё"}
+var allWordStems = normalizeAliases(allWords)
+
+// Title scores. Exact match of stem is always ranked above fuzzy match
+const (
+	exactWordScore     = 100
+	fuzzyWordScore     = 50
+	minFuzzySimilarity = 0.75
+	minFuzzyWordLen    = 4
+	// Score of devices, found by class word. Such devices are never ambiguous
+	classWordScore = 1
+)
+
 type CmdLocation struct {
-	Title string
+	Title   string
+	Aliases []string
+}
+type CmdScene struct {
+	Title   string
+	Aliases []string
+}
+type CmdGroup struct {
+	Title   string
+	Aliases []string
+	Devices []string
+	// Not stemmed aliases, usually plural forms, e.g. "lamps"
+	Forms []string
 }
 type CmdDevice struct {
 	Title      string
 	DevType    string
 	IDLocation int
+	Aliases    []string
+	Tags       []string
 }
 
 type context struct {
@@ -86,30 +191,145 @@ type context struct {
 	lastCmdLocations []int
 	lastCmdDevices   []string
 	defaultLocation  int
+
+	// Pending intent, waiting for user's choice of device
+	pendingDevices   []string
+	pendingLocations []int
+	pendingCmd       *CommandDef
+	// Time of delayed and duration of temporary pending command, zero if not set
+	pendingAt       time.Time
+	pendingDuration time.Duration
+	// Time and duration of pending command, which device was chosen by last processed phrase
+	chosenAt       time.Time
+	chosenDuration time.Duration
+
+	// States of devices before last commands, latest last
+	undoHistory [][]ZWayDeviceState
+
+	// Time, while last devices and locations are used for next commands
+	lifetime time.Duration
+	// Last devices or locations were used by last processed phrase
+	usedContext bool
+
+	// Guards context fields
+	lock sync.Mutex
+	// Serializes processing of sender's phrases
+	senderLock sync.Mutex
 }
 
+// Max number of commands, which can be undone
+const maxUndoSteps = 10
+
+const defaultContextLifetime = 60 * time.Second
+
 func (ctx *context) isExpired() bool {
-	return time.Now().Sub(ctx.lastCmdTime) > time.Duration(60*time.Second)
+	return time.Now().Sub(ctx.lastCmdTime) > ctx.lifetime
+}
+
+// reset clears all, except default location and lifetime. Must be called with lock held
+func (ctx *context) reset() {
+	ctx.lastCmdTime = time.Time{}
+	ctx.lastCmdLocations = nil
+	ctx.lastCmdDevices = nil
+	ctx.pendingDevices = nil
+	ctx.pendingLocations = nil
+	ctx.pendingCmd = nil
+	ctx.pendingAt, ctx.pendingDuration = time.Time{}, 0
+	ctx.chosenAt, ctx.chosenDuration = time.Time{}, 0
+	ctx.undoHistory = nil
+	ctx.usedContext = false
 }
 
+// CmdProcessor is safe for concurrent use. Phrases of different senders are processed in parallel,
+// and phrases of the same sender are serialized by LockSender
 type CmdProcessor struct {
 	locations map[int]CmdLocation
 	devices   map[string]CmdDevice
 	locNames  map[string]int
-
-	contexts map[string]*context
+	scenes    map[string]CmdScene
+	groups    map[string]*CmdGroup
+
+	// Inverted indexes of title and aliases stems. Locations are indexed by string id
+	devIndex   *titleIndex
+	locIndex   *titleIndex
+	groupIndex *titleIndex
+	sceneIndex *titleIndex
+
+	// Commands vocabulary and its indexes of command word stem to commands
+	commands []CommandDef
+	cmdIndex map[string][]int
+	// Device classes and index of class words, classes are indexed by string number
+	classes    []DeviceClass
+	classIndex *titleIndex
+
+	contexts        map[string]*context
+	contextLifetime time.Duration
+
+	// Ask user to choose device, if several devices have the same score
+	askAmbiguous bool
+
+	// Guards tables of locations, devices, scenes, groups and vocabulary
+	lock sync.RWMutex
+	// Guards contexts map
+	ctxLock sync.Mutex
 }
 
 func NewCmdProcessor() *CmdProcessor {
-	return &CmdProcessor{
-		locations: make(map[int]CmdLocation),
-		devices:   make(map[string]CmdDevice),
-		locNames:  make(map[string]int),
-		contexts:  make(map[string]*context),
+	cmd := &CmdProcessor{
+		locations:  make(map[int]CmdLocation),
+		devices:    make(map[string]CmdDevice),
+		locNames:   make(map[string]int),
+		scenes:     make(map[string]CmdScene),
+		groups:     make(map[string]*CmdGroup),
+		devIndex:   newTitleIndex(),
+		locIndex:   newTitleIndex(),
+		groupIndex: newTitleIndex(),
+		sceneIndex: newTitleIndex(),
+		contexts:   make(map[string]*context),
+
+		contextLifetime: defaultContextLifetime,
 	}
+	cmd.SetCommands(commands)
+	cmd.SetDeviceClasses(deviceClasses)
+	return cmd
 }
 
-func (cmd *CmdProcessor) AddDevice(id, title, devType string, location int) string {
+// SetCommands replaces commands vocabulary and stems command words
+func (cmd *CmdProcessor) SetCommands(commands []CommandDef) {
+	cmd.lock.Lock()
+	defer cmd.lock.Unlock()
+
+	cmd.commands = commands
+	cmd.cmdIndex = make(map[string][]int)
+	for i, c := range commands {
+		stem := strings.Join(splitPhrase(c.Words), " ")
+		cmd.cmdIndex[stem] = append(cmd.cmdIndex[stem], i)
+	}
+}
+
+// SetDeviceClasses replaces device classes and stems class words
+func (cmd *CmdProcessor) SetDeviceClasses(classes []DeviceClass) {
+	cmd.lock.Lock()
+	defer cmd.lock.Unlock()
+
+	cmd.classes = classes
+	cmd.classIndex = newTitleIndex()
+	for i, class := range classes {
+		words := normalizeAliases(class.Words)
+		if len(words) == 0 {
+			continue
+		}
+		cmd.classIndex.add(strconv.Itoa(i), words[0], words[1:])
+	}
+}
+
+func (cmd *CmdProcessor) AddDevice(id, title, devType string, location int, aliases []string) string {
+	cmd.lock.Lock()
+	defer cmd.lock.Unlock()
+	return cmd.addDevice(id, title, devType, location, aliases)
+}
+
+func (cmd *CmdProcessor) addDevice(id, title, devType string, location int, aliases []string) string {
 	titles := splitPhrase(title)
 
 	title = ""
@@ -119,11 +339,22 @@ func (cmd *CmdProcessor) AddDevice(id, title, devType string, location int) stri
 		}
 	}
 
-	cmd.devices[id] = CmdDevice{title, devType, location}
+	aliases = normalizeAliases(aliases)
+	if _, found := cmd.devices[id]; found {
+		cmd.devIndex.remove(id)
+	}
+	cmd.devices[id] = CmdDevice{title, devType, location, aliases, nil}
+	cmd.devIndex.add(id, title, aliases)
 	return title
 }
 
-func (cmd *CmdProcessor) AddLocation(id int, title string) string {
+func (cmd *CmdProcessor) AddLocation(id int, title string, aliases []string) string {
+	cmd.lock.Lock()
+	defer cmd.lock.Unlock()
+	return cmd.addLocation(id, title, aliases)
+}
+
+func (cmd *CmdProcessor) addLocation(id int, title string, aliases []string) string {
 	if id == 0 {
 		title = "везде"
 	}
@@ -131,40 +362,288 @@ func (cmd *CmdProcessor) AddLocation(id int, title string) string {
 	title = strings.Join(splitPhrase(title), " ")
 	cmd.locNames[title] = id
 
-	cmd.locations[id] = CmdLocation{title}
+	aliases = normalizeAliases(aliases)
+	for _, alias := range aliases {
+		cmd.locNames[alias] = id
+	}
+
+	if _, found := cmd.locations[id]; found {
+		cmd.locIndex.remove(strconv.Itoa(id))
+	}
+	cmd.locations[id] = CmdLocation{title, aliases}
+	cmd.locIndex.add(strconv.Itoa(id), title, aliases)
 	return title
 }
 
+// AddDeviceTag adds device to group of devices with the same ZWay tag. Device should be already added
+func (cmd *CmdProcessor) AddDeviceTag(devID, tag string, aliases []string) string {
+	cmd.lock.Lock()
+	defer cmd.lock.Unlock()
+	return cmd.addDeviceTag(devID, tag, aliases)
+}
+
+func (cmd *CmdProcessor) addDeviceTag(devID, tag string, aliases []string) string {
+	group, found := cmd.groups[tag]
+	if !found {
+		forms := []string{}
+		for _, alias := range aliases {
+			if form := lowerWords(alias); len(form) != 0 {
+				forms = append(forms, form)
+			}
+		}
+		group = &CmdGroup{strings.Join(splitPhrase(tag), " "), normalizeAliases(aliases), nil, forms}
+		cmd.groups[tag] = group
+		cmd.groupIndex.add(tag, group.Title, group.Aliases)
+	}
+	group.Devices = append(group.Devices, devID)
+
+	dev := cmd.devices[devID]
+	dev.Tags = append(dev.Tags, tag)
+	cmd.devices[devID] = dev
+	return group.Title
+}
+
+// AddScene adds scene, which is matched by phrase containing all words of scene name or alias
+func (cmd *CmdProcessor) AddScene(name string, aliases []string) string {
+	cmd.lock.Lock()
+	defer cmd.lock.Unlock()
+
+	title := strings.Join(splitPhrase(name), " ")
+	aliases = normalizeAliases(aliases)
+	if _, found := cmd.scenes[name]; found {
+		cmd.sceneIndex.remove(name)
+	}
+	cmd.scenes[name] = CmdScene{title, aliases}
+	cmd.sceneIndex.add(name, title, aliases)
+	return title
+}
+
+// SetContextLifetime sets lifetime of contexts, which lifetime is not set by SetSenderContextLifetime
+func (cmd *CmdProcessor) SetContextLifetime(lifetime time.Duration) {
+	cmd.ctxLock.Lock()
+	defer cmd.ctxLock.Unlock()
+
+	for _, ctx := range cmd.contexts {
+		ctx.lock.Lock()
+		if ctx.lifetime == cmd.contextLifetime {
+			ctx.lifetime = lifetime
+		}
+		ctx.lock.Unlock()
+	}
+	cmd.contextLifetime = lifetime
+}
+
+func (cmd *CmdProcessor) SetSenderContextLifetime(ctxName string, lifetime time.Duration) {
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	ctx.lifetime = lifetime
+	ctx.lock.Unlock()
+}
+
+// ResetContext clears last devices and locations of sender. Default location and lifetime are kept
+func (cmd *CmdProcessor) ResetContext(ctxName string) {
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	ctx.reset()
+	ctx.lock.Unlock()
+}
+
+// IsContextUsed returns true, if last devices or locations were used by last processed phrase of sender
+func (cmd *CmdProcessor) IsContextUsed(ctxName string) bool {
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.usedContext
+}
+
+// SetPendingSchedule sets time of delayed or duration of temporary command, which waits for user's choice of device
+func (cmd *CmdProcessor) SetPendingSchedule(ctxName string, at time.Time, duration time.Duration) {
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	ctx.pendingAt, ctx.pendingDuration = at, duration
+}
+
+// ChosenSchedule returns time and duration, set by SetPendingSchedule, if device was chosen by last processed phrase
+func (cmd *CmdProcessor) ChosenSchedule(ctxName string) (time.Time, time.Duration) {
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+	return ctx.chosenAt, ctx.chosenDuration
+}
+
+// LockSender serializes processing of sender's phrases. Returns function to unlock sender
+func (cmd *CmdProcessor) LockSender(ctxName string) func() {
+	ctx := cmd.getContext(ctxName)
+	ctx.senderLock.Lock()
+	return ctx.senderLock.Unlock
+}
+
+func (cmd *CmdProcessor) SetAskAmbiguous(askAmbiguous bool) {
+	cmd.lock.Lock()
+	cmd.askAmbiguous = askAmbiguous
+	cmd.lock.Unlock()
+}
+
 func (cmd *CmdProcessor) SetContextDefaultLocation(ctxName string, defaultLocTitle string) bool {
 
 	defaultLocTitle = strings.Join(splitPhrase(defaultLocTitle), " ")
+	cmd.lock.RLock()
 	locID, found := cmd.locNames[defaultLocTitle]
+	cmd.lock.RUnlock()
 	if !found {
 		return false
 	}
-	cmd.contexts[ctxName] = &context{defaultLocation: locID}
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	ctx.defaultLocation = locID
+	ctx.lock.Unlock()
 	return true
 }
 
-func (cmd *CmdProcessor) ProcessPhrase(phrase string, ctxName string) (devIDs []string, locIDs []int, cmdPtr *CommandDef) {
+// PushUndo saves states of devices before command, which can be restored by undo command
+func (cmd *CmdProcessor) PushUndo(ctxName string, states []ZWayDeviceState) {
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+
+	ctx.undoHistory = append(ctx.undoHistory, states)
+	if len(ctx.undoHistory) > maxUndoSteps {
+		ctx.undoHistory = ctx.undoHistory[len(ctx.undoHistory)-maxUndoSteps:]
+	}
+}
+
+// PopUndo returns states of devices before last command
+func (cmd *CmdProcessor) PopUndo(ctxName string) []ZWayDeviceState {
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+
+	if len(ctx.undoHistory) == 0 {
+		return nil
+	}
+	states := ctx.undoHistory[len(ctx.undoHistory)-1]
+	ctx.undoHistory = ctx.undoHistory[:len(ctx.undoHistory)-1]
+	return states
+}
+
+func (cmd *CmdProcessor) getContext(ctxName string) *context {
+	cmd.ctxLock.Lock()
+	defer cmd.ctxLock.Unlock()
 
 	ctx, found := cmd.contexts[ctxName]
 	if !found {
-		ctx = &context{}
+		ctx = &context{lifetime: cmd.contextLifetime}
 		cmd.contexts[ctxName] = ctx
 	}
+	return ctx
+}
+
+func (cmd *CmdProcessor) ProcessPhrase(phrase string, ctxName string) (devIDs []string, locIDs []int, cmdPtr *CommandDef) {
+
+	cmd.lock.RLock()
+	defer cmd.lock.RUnlock()
+
+	ctx := cmd.getContext(ctxName)
+	ctx.lock.Lock()
+	defer ctx.lock.Unlock()
+
+	ctx.usedContext = false
+	ctx.chosenAt, ctx.chosenDuration = time.Time{}, 0
+
+	if cmdPtr = cmd.findCommand(phrase, "*"); cmdPtr != nil && (cmdPtr.Command == CommandUndo || cmdPtr.Command == CommandReset) {
+		log.Printf("Locked up command '%s'", cmdPtr.Words)
+		if cmdPtr.Command == CommandReset {
+			ctx.reset()
+		}
+		return nil, nil, cmdPtr
+	}
 
-	locIDs = cmd.lookupLocation(phrase, ctx)
+	if sceneName := cmd.lookupScene(splitPhrase(phrase)); len(sceneName) != 0 {
+		return nil, nil, &CommandDef{sceneName, []string{"*"}, CommandScene, sceneName}
+	}
+
+	if len(ctx.pendingDevices) != 0 {
+		pendingDevices := ctx.pendingDevices
+		ctx.pendingDevices = nil
+		// User's answer to clarification, e.g. "2"
+		if n, err := strconv.Atoi(strings.TrimSpace(phrase)); err == nil && !ctx.isExpired() && n >= 1 && n <= len(pendingDevices) {
+			devIDs = []string{pendingDevices[n-1]}
+			log.Printf("Chosen '%s'", cmd.devices[devIDs[0]].Title)
+			ctx.lastCmdDevices = devIDs
+			ctx.lastCmdLocations = ctx.pendingLocations
+			ctx.lastCmdTime = time.Now()
+			ctx.chosenAt, ctx.chosenDuration = ctx.pendingAt, ctx.pendingDuration
+			return devIDs, ctx.pendingLocations, ctx.pendingCmd
+		}
+	}
+
+	phrase, exceptPhrase := splitExcept(phrase)
+	words := splitPhrase(phrase)
+	// Device titles don't change while phrase is processed, so they are scored once
+	devScores := cmd.devIndex.scores(words)
+
+	locIDs = cmd.lookupLocation(words, ctx)
+
+	if isQuestion(phrase) {
+		devIDs, _ = cmd.lookupDevice(words, devScores, locIDs, map[string]bool{}, ctx)
+		if len(devIDs) == 0 {
+			return nil, nil, nil
+		}
+		ctx.lastCmdDevices = devIDs
+		ctx.lastCmdLocations = locIDs
+		ctx.lastCmdTime = time.Now()
+		return devIDs, locIDs, &queryCommand
+	}
 
+	// Sensors can be only queried
 	excludeDevs := make(map[string]bool)
+	for id, dev := range cmd.devices {
+		if isSensor(dev.DevType) {
+			excludeDevs[id] = true
+		}
+	}
+
+	if len(exceptPhrase) != 0 || hasAnyWord(words, allWordStems) {
+		devIDs, cmdPtr = cmd.lookupAllDevices(phrase, words, exceptPhrase, locIDs, excludeDevs)
+		if len(devIDs) == 0 || cmdPtr == nil {
+			return nil, nil, nil
+		}
+		ctx.lastCmdDevices = devIDs
+		ctx.lastCmdLocations = locIDs
+		ctx.lastCmdTime = time.Now()
+		return devIDs, locIDs, cmdPtr
+	}
+
+	// Groups are used for group alias as is, e.g. "lamps", or if no device title matches. Otherwise device is chosen
+	if cmd.hasGroupForm(phrase) || !hasDeviceTitle(devScores, excludeDevs) {
+		if devIDs = cmd.lookupGroup(words, locIDs, excludeDevs); len(devIDs) != 0 {
+			if cmdPtr = cmd.lookupCommand(phrase, "*"); cmdPtr != nil {
+				devIDs, cmdPtr = cmd.resolveLevel(phrase, words, cmd.filterDevType(devIDs, cmdPtr.DevTypes), cmdPtr)
+			}
+			if len(devIDs) != 0 {
+				ctx.lastCmdDevices = devIDs
+				ctx.lastCmdLocations = locIDs
+				ctx.lastCmdTime = time.Now()
+				return devIDs, locIDs, cmdPtr
+			}
+		}
+	}
+
 	devScore := 0
 	for {
-		devIDs, devScore = cmd.lookupDevice(phrase, locIDs, excludeDevs, ctx)
+		devIDs, devScore = cmd.lookupDevice(words, devScores, locIDs, excludeDevs, ctx)
 		if len(devIDs) == 0 {
-			return nil, nil, nil
+			// No device titles, e.g. "warmer in the bedroom": thermostat command is for thermostats in location
+			if devIDs, cmdPtr = cmd.lookupThermostats(phrase, locIDs, excludeDevs); len(devIDs) == 0 {
+				return nil, nil, nil
+			}
+			devScore = classWordScore
+			break
 		}
 		cmdPtr = cmd.lookupCommand(phrase, cmd.devices[devIDs[0]].DevType)
-		if cmdPtr != nil || cmd.lookupCommand(phrase, "*") == nil {
+		// Try next device, if command words are for other device types. Level without command word is not such case
+		if cmdPtr != nil || cmd.findCommandWord(phrase, "*") == nil {
 			break
 		}
 		for _, devID := range devIDs {
@@ -176,6 +655,16 @@ func (cmd *CmdProcessor) ProcessPhrase(phrase string, ctxName string) (devIDs []
 		return nil, nil, nil
 	}
 
+	if cmd.askAmbiguous && devScore > classWordScore && len(devIDs) > 1 {
+		log.Printf("Asking to choose one of %d devices", len(devIDs))
+		ctx.pendingDevices = devIDs
+		ctx.pendingLocations = locIDs
+		ctx.pendingCmd = cmdPtr
+		ctx.pendingAt, ctx.pendingDuration = time.Time{}, 0
+		ctx.lastCmdTime = time.Now()
+		return devIDs, locIDs, &chooseCommand
+	}
+
 	ctx.lastCmdDevices = devIDs
 	ctx.lastCmdLocations = locIDs
 	ctx.lastCmdTime = time.Now()
@@ -183,7 +672,7 @@ func (cmd *CmdProcessor) ProcessPhrase(phrase string, ctxName string) (devIDs []
 	return devIDs, locIDs, cmdPtr
 }
 
-func (cmd *CmdProcessor) lookupDevice(phrase string, locations []int, excludeDevs map[string]bool, ctx *context) ([]string, int) {
+func (cmd *CmdProcessor) lookupDevice(words []string, scores map[string]int, locations []int, excludeDevs map[string]bool, ctx *context) ([]string, int) {
 
 	bestDevScore, bestDevIDs := 0, []string{}
 	for id, dev := range cmd.devices {
@@ -194,7 +683,7 @@ func (cmd *CmdProcessor) lookupDevice(phrase string, locations []int, excludeDev
 		}
 
 		// get phrase score
-		score := getTitleScore(phrase, dev.Title)
+		score := scores[id]
 
 		// check if device doesn't match location decrease score
 		if len(locations) > 0 && locations[0] != 0 {
@@ -203,7 +692,7 @@ func (cmd *CmdProcessor) lookupDevice(phrase string, locations []int, excludeDev
 				locMatch = locMatch || (dev.IDLocation == loc)
 			}
 			if !locMatch {
-				score--
+				score -= exactWordScore
 			}
 		}
 
@@ -219,6 +708,13 @@ func (cmd *CmdProcessor) lookupDevice(phrase string, locations []int, excludeDev
 		}
 	}
 
+	if len(bestDevIDs) == 0 {
+		// No devices found by title. Try to lookup devices by class word, e.g. "light"
+		if bestDevIDs = cmd.lookupClass(words, locations, excludeDevs); len(bestDevIDs) != 0 {
+			bestDevScore = classWordScore
+		}
+	}
+
 	if len(bestDevIDs) == 0 && !ctx.isExpired() {
 		// No devices found. Try fallback to device from context
 		for _, devID := range ctx.lastCmdDevices {
@@ -242,19 +738,300 @@ func (cmd *CmdProcessor) lookupDevice(phrase string, locations []int, excludeDev
 			log.Printf("Looked up '%s', score=%d", devNames, bestDevScore)
 		} else {
 			log.Printf("Using '%s' from last context", devNames)
+			ctx.usedContext = true
 		}
 	}
 
 	return bestDevIDs, bestDevScore
 }
 
-func (cmd *CmdProcessor) lookupLocation(phrase string, ctx *context) []int {
+// lookupAllDevices selects all devices in locations, which are matched by phrase title or accept command,
+// and subtracts devices (or whole locations) named in exceptPhrase
+func (cmd *CmdProcessor) lookupAllDevices(phrase string, words []string, exceptPhrase string, locations []int, excludeDevs map[string]bool) ([]string, *CommandDef) {
+
+	cmdPtr := cmd.lookupCommand(phrase, "*")
+	if cmdPtr == nil {
+		return nil, nil
+	}
+
+	inLocation := func(dev CmdDevice) bool {
+		if len(locations) == 0 || locations[0] == 0 {
+			return true
+		}
+		for _, loc := range locations {
+			if dev.IDLocation == loc {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Device titles in phrase narrow selection, e.g. "all lamps except the lamp in the cabinet"
+	scores, groupScores := cmd.devIndex.scores(words), cmd.groupIndex.scores(words)
+	bestDevScore, devIDs := 0, []string{}
+	for id, dev := range cmd.devices {
+		if _, excluded := excludeDevs[id]; excluded || !inLocation(dev) {
+			continue
+		}
+		score := scores[id]
+		for _, tag := range dev.Tags {
+			if groupScore := groupScores[tag]; groupScore > score {
+				score = groupScore
+			}
+		}
+		if score > bestDevScore {
+			bestDevScore = score
+			devIDs = devIDs[:0]
+		}
+		if score == bestDevScore && (score != 0 || isBroadMatch(dev.DevType, cmdPtr)) {
+			devIDs = append(devIDs, id)
+		}
+	}
+
+	if len(exceptPhrase) != 0 {
+		exceptWords := splitPhrase(exceptPhrase)
+		exceptScores := cmd.devIndex.scores(exceptWords)
+		exceptDevs := make(map[string]bool)
+		for _, id := range devIDs {
+			if exceptScores[id] > 0 {
+				exceptDevs[id] = true
+			}
+		}
+		if len(exceptDevs) == 0 {
+			// No devices matched - try to exclude whole locations
+			locScores := cmd.locIndex.scores(exceptWords)
+			for _, id := range devIDs {
+				if locScores[strconv.Itoa(cmd.devices[id].IDLocation)] > 0 {
+					exceptDevs[id] = true
+				}
+			}
+		}
+		if len(exceptDevs) == 0 {
+			log.Printf("Can't lookup excluded devices '%s'", exceptPhrase)
+		}
+
+		filtered := devIDs[:0]
+		for _, id := range devIDs {
+			if _, excluded := exceptDevs[id]; !excluded {
+				filtered = append(filtered, id)
+			}
+		}
+		devIDs = filtered
+	}
+
+	devNames := ""
+	for i, devID := range devIDs {
+		if i != 0 {
+			devNames += ","
+		}
+		devNames += cmd.devices[devID].Title
+	}
+	log.Printf("Looked up all '%s', except '%s'", devNames, exceptPhrase)
+
+	return cmd.resolveLevel(phrase, words, devIDs, cmdPtr)
+}
+
+// resolveLevel replaces level command for any device type by dimmer or thermostat level and keeps devices of chosen type.
+// Degrees are for thermostats and percents for dimmers. Level without unit is for thermostats,
+// if there are no dimmers or phrase has class word of thermostats, e.g. "all heating to 22"
+func (cmd *CmdProcessor) resolveLevel(phrase string, words []string, devIDs []string, cmdPtr *CommandDef) ([]string, *CommandDef) {
+	if cmdPtr == nil || cmdPtr.Command != CommandLevel {
+		return devIDs, cmdPtr
+	}
+
+	_, unit, _ := parseLevel(phrase)
+	types := dimmerDevTypes
+	if unit == "°" || (unit == "" && (len(cmd.filterDevType(devIDs, dimmerDevTypes)) == 0 || cmd.hasClassWord(words, thermostatDevTypes[0]))) {
+		types = thermostatDevTypes
+	}
+	devIDs = cmd.filterDevType(devIDs, types)
+	if len(devIDs) == 0 {
+		return devIDs, nil
+	}
+	return devIDs, cmd.lookupCommand(phrase, types[0])
+}
+
+// lookupGroup returns devices of groups, which tag is exactly matched by phrase.
+// Devices are narrowed to locations, if any device of group is there
+func (cmd *CmdProcessor) lookupGroup(words []string, locations []int, excludeDevs map[string]bool) []string {
+
+	bestGroupScore, bestGroups := exactWordScore-1, []string{}
+	for tag, score := range cmd.groupIndex.scores(words) {
+		if score > bestGroupScore {
+			bestGroupScore = score
+			bestGroups = bestGroups[:0]
+		}
+		if score == bestGroupScore {
+			bestGroups = append(bestGroups, tag)
+		}
+	}
+	if len(bestGroups) == 0 {
+		return nil
+	}
+
+	devIDs, locDevIDs := []string{}, []string{}
+	used := make(map[string]bool)
+	for _, tag := range bestGroups {
+		for _, devID := range cmd.groups[tag].Devices {
+			if _, excluded := excludeDevs[devID]; excluded || used[devID] {
+				continue
+			}
+			used[devID] = true
+			devIDs = append(devIDs, devID)
+			for _, loc := range locations {
+				if loc == cmd.devices[devID].IDLocation {
+					locDevIDs = append(locDevIDs, devID)
+				}
+			}
+		}
+	}
+	if len(locDevIDs) != 0 {
+		devIDs = locDevIDs
+	}
+
+	log.Printf("Looked up group '%s' with %d devices, score=%d", strings.Join(bestGroups, ","), len(devIDs), bestGroupScore)
+	return devIDs
+}
+
+// hasGroupForm returns true, if phrase contains not stemmed alias of any group
+func (cmd *CmdProcessor) hasGroupForm(phrase string) bool {
+	lphrase := " " + lowerWords(phrase) + " "
+	for _, group := range cmd.groups {
+		for _, form := range group.Forms {
+			if strings.Contains(lphrase, " "+form+" ") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasDeviceTitle returns true, if any not excluded device title or alias has score
+func hasDeviceTitle(scores map[string]int, excludeDevs map[string]bool) bool {
+	for id, score := range scores {
+		if _, excluded := excludeDevs[id]; !excluded && score > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupClass returns devices in locations, which are matched by class word in phrase
+func (cmd *CmdProcessor) lookupClass(words []string, locations []int, excludeDevs map[string]bool) []string {
+
+	matched := make(map[string]bool)
+	for ref, score := range cmd.classIndex.titleScores(words) {
+		matched[ref.id] = matched[ref.id] || score >= exactWordScore
+	}
+
+	devIDs := []string{}
+	for i := range cmd.classes {
+		class := &cmd.classes[i]
+		if !matched[strconv.Itoa(i)] {
+			continue
+		}
+
+		for id, dev := range cmd.devices {
+			if _, excluded := excludeDevs[id]; excluded || !class.isMatch(dev.DevType, dev.Tags) {
+				continue
+			}
+			locMatch := len(locations) == 0 || locations[0] == 0
+			for _, loc := range locations {
+				locMatch = locMatch || (dev.IDLocation == loc)
+			}
+			if locMatch {
+				devIDs = append(devIDs, id)
+			}
+		}
+		if len(devIDs) != 0 {
+			log.Printf("Looked up %d devices of class '%s'", len(devIDs), class.Words[0])
+			break
+		}
+	}
+	return devIDs
+}
+
+// hasClassWord returns true, if phrase has class word of class with devices of devType
+func (cmd *CmdProcessor) hasClassWord(words []string, devType string) bool {
+	for ref, score := range cmd.classIndex.titleScores(words) {
+		i, _ := strconv.Atoi(ref.id)
+		if score >= exactWordScore && isDevTypeMatch(devType, cmd.classes[i].DevTypes) {
+			return true
+		}
+	}
+	return false
+}
+
+// lookupThermostats returns thermostats in locations, if phrase has command word only for thermostats
+func (cmd *CmdProcessor) lookupThermostats(phrase string, locations []int, excludeDevs map[string]bool) ([]string, *CommandDef) {
+	cmdPtr := cmd.findCommandWord(phrase, thermostatDevTypes[0])
+	if cmdPtr == nil || len(cmdPtr.DevTypes) == 0 {
+		return nil, nil
+	}
+	for _, t := range cmdPtr.DevTypes {
+		if t == "*" || !isDevTypeMatch(t, thermostatDevTypes) {
+			return nil, nil
+		}
+	}
+
+	devIDs := []string{}
+	for id, dev := range cmd.devices {
+		if _, excluded := excludeDevs[id]; excluded || !isDevTypeMatch(dev.DevType, thermostatDevTypes) {
+			continue
+		}
+		locMatch := len(locations) == 0 || locations[0] == 0
+		for _, loc := range locations {
+			locMatch = locMatch || (dev.IDLocation == loc)
+		}
+		if locMatch {
+			devIDs = append(devIDs, id)
+		}
+	}
+	if len(devIDs) != 0 {
+		log.Printf("Looked up %d thermostats for command '%s'", len(devIDs), cmdPtr.Words)
+	}
+	return devIDs, cmdPtr
+}
+
+func (cmd *CmdProcessor) filterDevType(devIDs []string, types []string) []string {
+	ret := []string{}
+	for _, devID := range devIDs {
+		if isDevTypeMatch(cmd.devices[devID].DevType, types) {
+			ret = append(ret, devID)
+		}
+	}
+	return ret
+}
+
+func (cmd *CmdProcessor) lookupScene(words []string) string {
 
+	bestSceneScore, bestScene := 0, ""
+	for ref, score := range cmd.sceneIndex.titleScores(words) {
+		scene := cmd.scenes[ref.id]
+		title := scene.Title
+		if ref.title != 0 {
+			title = scene.Aliases[ref.title-1]
+		}
+		// All words of scene title should be in phrase
+		if score >= exactWordScore*len(strings.Fields(title)) && (score > bestSceneScore || (score == bestSceneScore && ref.id < bestScene)) {
+			bestSceneScore, bestScene = score, ref.id
+		}
+	}
+
+	if len(bestScene) != 0 {
+		log.Printf("Looked up scene '%s', score=%d", bestScene, bestSceneScore)
+	}
+	return bestScene
+}
+
+func (cmd *CmdProcessor) lookupLocation(words []string, ctx *context) []int {
+
+	scores := cmd.locIndex.scores(words)
 	bestLocScore, bestLocIDs := 0, []int{}
 
-	for id, loc := range cmd.locations {
+	for id := range cmd.locations {
 
-		score := getTitleScore(phrase, loc.Title)
+		score := scores[strconv.Itoa(id)]
 
 		if score > bestLocScore {
 			bestLocScore = score
@@ -268,6 +1045,7 @@ func (cmd *CmdProcessor) lookupLocation(phrase string, ctx *context) []int {
 	if bestLocScore == 0 {
 		if !ctx.isExpired() {
 			bestLocIDs = ctx.lastCmdLocations
+			ctx.usedContext = len(bestLocIDs) != 0
 		} else {
 			bestLocIDs = []int{ctx.defaultLocation}
 		}
@@ -294,33 +1072,123 @@ func (cmd *CmdProcessor) lookupLocation(phrase string, ctx *context) []int {
 }
 
 func (cmd *CmdProcessor) lookupCommand(command, devType string) *CommandDef {
-	wordsCmd := splitPhrase(command)
+	cmdDef := cmd.findCommand(command, devType)
 
-	var cmdDef *CommandDef
+	if cmdDef != nil {
+		log.Printf("Locked up command '%s'", cmdDef.Words)
+	} else if devType == "*" {
+		log.Printf("Can't lookup command '%s'", command)
+	}
+
+	return cmdDef
+}
 
-	for _, w := range wordsCmd {
-		for cmdID, c := range commands {
+func (cmd *CmdProcessor) findCommand(command, devType string) *CommandDef {
+	cmdDef := cmd.findCommandWord(command, devType)
+
+	if cmdDef == nil || cmdDef.Command == CommandOn {
+		// Phrase may contain absolute level, e.g. "dimmer 40%" or "turn on heating to 22 degrees"
+		if level, unit, found := parseLevel(command); found {
+			if devType == "*" {
+				// Level depends on device type, so command is chosen by resolveLevel
+				cmdDef = &CommandDef{"уровень " + strconv.Itoa(level), levelDevTypes, CommandLevel, CommandDataLevel{level}}
+			} else if isDevTypeMatch(devType, dimmerDevTypes) && unit != "°" {
+				level = clampDeviceLevel(level)
+				cmdDef = &CommandDef{"уровень " + strconv.Itoa(level), dimmerDevTypes, CommandDimmerLevel, CommandDataLevel{level}}
+			} else if isDevTypeMatch(devType, thermostatDevTypes) && unit != "%" {
+				level = clampThermostatLevel(level)
+				cmdDef = &CommandDef{"температура " + strconv.Itoa(level), thermostatDevTypes, CommandThermostatLevel, CommandDataLevel{level}}
+			}
+		}
+	}
+	return cmdDef
+}
 
-			cmdWord, _ := snowball.Stem(c.Words, "russian", true)
+// findCommandWord looks up command only by command words of phrase
+func (cmd *CmdProcessor) findCommandWord(command, devType string) *CommandDef {
+	var cmdDef *CommandDef
 
-			if isDevTypeMatch(devType, c.DevTypes) && w == cmdWord {
-				cmdDef = &commands[cmdID]
+	for _, w := range splitPhrase(command) {
+		for _, cmdID := range cmd.cmdIndex[w] {
+			if isDevTypeMatch(devType, cmd.commands[cmdID].DevTypes) {
+				cmdDef = &cmd.commands[cmdID]
 			}
 		}
 	}
-	if cmdDef != nil {
-		log.Printf("Locked up command '%s'", cmdDef.Words)
-	} else if devType == "*" {
-		log.Printf("Can't lookup command '%s'", command)
+	return cmdDef
+}
+
+// SplitClauses splits phrase to independent clauses by conjunctions and commas.
+// Part of phrase without own command or scene name is joined to previous clause,
+// e.g. "heat floor in the bathroom and toilet" is kept as single clause
+func (cmd *CmdProcessor) SplitClauses(phrase string) []string {
+	cmd.lock.RLock()
+	defer cmd.lock.RUnlock()
+
+	phrase = strings.NewReplacer(",", " , ", ";", " ; ").Replace(phrase)
+
+	parts := []string{}
+	part := ""
+	for _, w := range strings.Fields(phrase) {
+		if _, found := clauseSeparators[strings.ToLower(w)]; found {
+			parts = append(parts, part)
+			part = ""
+			continue
+		}
+		part += w + " "
 	}
+	parts = append(parts, part)
 
-	return cmdDef
+	clauses := []string{}
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if len(part) == 0 {
+			continue
+		}
+		if len(clauses) != 0 && cmd.findCommand(part, "*") == nil && len(cmd.lookupScene(splitPhrase(part))) == 0 {
+			clauses[len(clauses)-1] += " " + part
+		} else {
+			clauses = append(clauses, part)
+		}
+	}
+	return clauses
+}
+
+// HasDevice returns true if device is known
+func (cmd *CmdProcessor) HasDevice(id string) bool {
+	cmd.lock.RLock()
+	defer cmd.lock.RUnlock()
+	_, found := cmd.devices[id]
+	return found
 }
 
 func (cmd *CmdProcessor) GetLocationTitle(id int) string {
+	cmd.lock.RLock()
+	defer cmd.lock.RUnlock()
 	return cmd.locations[id].Title
 }
 
+func isSensor(devType string) bool {
+	for _, t := range sensorDevTypes {
+		if t == devType {
+			return true
+		}
+	}
+	return false
+}
+
+// isBroadMatch returns true, if device is selected by "all" without title.
+// Scene buttons are never selected, and thermostats are not turned on or off
+func isBroadMatch(devType string, cmdPtr *CommandDef) bool {
+	if devType == "toggleButton" {
+		return false
+	}
+	if (cmdPtr.Command == CommandOn || cmdPtr.Command == CommandOff) && isDevTypeMatch(devType, thermostatDevTypes) {
+		return false
+	}
+	return isDevTypeMatch(devType, cmdPtr.DevTypes)
+}
+
 func isDevTypeMatch(devType string, types []string) bool {
 	if (len(types) == 1 && types[0] == "*") || devType == "*" {
 		return true
@@ -334,6 +1202,79 @@ func isDevTypeMatch(devType string, types []string) bool {
 	return false
 }
 
+// parseLevel returns first absolute level found in phrase and its unit: "%", "°" or empty, if level is after preposition
+func parseLevel(phrase string) (int, string, bool) {
+	for _, m := range reLevel.FindAllStringSubmatch(strings.ToLower(phrase), -1) {
+		unit := ""
+		switch {
+		case strings.HasPrefix(m[3], "%") || strings.HasPrefix(m[3], "процент") || strings.HasPrefix(m[3], "percent"):
+			unit = "%"
+		case strings.HasPrefix(m[3], "°") || strings.HasPrefix(m[3], "градус") || strings.HasPrefix(m[3], "degree"):
+			unit = "°"
+		case len(m[3]) != 0 || len(m[1]) == 0:
+			// Duration or number without preposition
+			continue
+		}
+		level, err := strconv.Atoi(m[2])
+		if err != nil {
+			continue
+		}
+		return level, unit, true
+	}
+	return 0, "", false
+}
+
+// splitExcept splits phrase to main part and part with excluded devices
+func splitExcept(phrase string) (string, string) {
+	lphrase := " " + strings.ToLower(phrase) + " "
+	for _, sep := range exceptSeparators {
+		if pos := strings.Index(lphrase, " "+sep+" "); pos >= 0 {
+			return lphrase[:pos], lphrase[pos+len(sep)+1:]
+		}
+	}
+	return phrase, ""
+}
+
+func isQuestion(phrase string) bool {
+	if strings.Contains(phrase, "?") {
+		return true
+	}
+	words := strings.FieldsFunc(strings.ToLower(phrase), func(r rune) bool { return !unicode.IsLetter(r) })
+	for i, w := range words {
+		for _, qw := range questionWords {
+			if w == qw {
+				return true
+			}
+		}
+		for _, qw := range questionStartWords {
+			if i == 0 && w == qw {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// hasAnyWord returns true if stemmed phrase words contain any of stems
+func hasAnyWord(words []string, stems []string) bool {
+	for _, pw := range words {
+		for _, w := range stems {
+			if w == pw {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// lowerWords returns lower case letter words of phrase, separated by single space
+func lowerWords(phrase string) string {
+	words := strings.FieldsFunc(strings.ToLower(strings.Replace(phrase, "ё", "е", -1)), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	return strings.Join(words, " ")
+}
+
 func splitPhrase(phrase string) []string {
 	buf := bytes.Buffer{}
 
@@ -351,26 +1292,82 @@ func splitPhrase(phrase string) []string {
 	words := strings.Split(buf.String(), " ")
 	rwords := make([]string, 0, len(words))
 	for i := range words {
-		word, err := snowball.Stem(words[i], "russian", true)
-		if err == nil && utf8.RuneCountInString(word) > 1 {
+		if word := stemWord(words[i]); utf8.RuneCountInString(word) > 1 {
 			rwords = append(rwords, word)
 		}
 	}
 	return rwords
 }
 
-func getTitleScore(phrase, title string) int {
-	wordsPhrase := splitPhrase(phrase)
-	wordsTitle := splitPhrase(title)
-	score := 0
+// stemWord stems lower case word with stemmer of word's language
+func stemWord(word string) string {
+	lang := detectLanguage(word)
+	if len(lang) == 0 {
+		return word
+	}
+	stem, err := snowball.Stem(word, lang, true)
+	if err != nil {
+		return word
+	}
+	return stem
+}
+
+// detectLanguage returns snowball language name by word's alphabet
+func detectLanguage(word string) string {
+	for _, r := range word {
+		switch {
+		case unicode.Is(unicode.Cyrillic, r):
+			return "russian"
+		case unicode.Is(unicode.Latin, r):
+			return "english"
+		}
+	}
+	return ""
+}
 
-	for _, pw := range wordsPhrase {
-		for _, tw := range wordsTitle {
-			if tw == pw {
-				score++
+func normalizeAliases(aliases []string) []string {
+	ret := make([]string, 0, len(aliases))
+	for _, alias := range aliases {
+		if alias = strings.Join(splitPhrase(alias), " "); len(alias) != 0 {
+			ret = append(ret, alias)
+		}
+	}
+	return ret
+}
+
+// getWordSimilarity returns 1 - (edit distance / length of longer word)
+func getWordSimilarity(w1, w2 string) float64 {
+	r1, r2 := []rune(w1), []rune(w2)
+	if len(r1) < minFuzzyWordLen || len(r2) < minFuzzyWordLen {
+		return 0
+	}
+
+	prev := make([]int, len(r2)+1)
+	cur := make([]int, len(r2)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(r1); i++ {
+		cur[0] = i
+		for j := 1; j <= len(r2); j++ {
+			cost := 1
+			if r1[i-1] == r2[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
 			}
 		}
+		prev, cur = cur, prev
 	}
 
-	return score
+	maxLen := len(r1)
+	if len(r2) > maxLen {
+		maxLen = len(r2)
+	}
+	return 1 - float64(prev[len(r2)])/float64(maxLen)
 }
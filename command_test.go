@@ -0,0 +1,187 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+	"testing"
+)
+
+var testRooms = []string{"кухня", "спальня", "гостиная", "ванная", "кабинет", "детская", "коридор", "балкон"}
+var testKinds = []string{"лампа", "люстра", "торшер", "розетка", "бра", "подсветка"}
+var testSyllables = []string{"ба", "ве", "ги", "до", "зу", "ка", "ле", "ми", "но", "пу"}
+
+// testWord returns letter only word, distinct for each i < 1000. Words of different i differ at least in two letters
+func testWord(i int) string {
+	word := ""
+	for k := 0; k < 3; k++ {
+		word += testSyllables[i%len(testSyllables)]
+		i /= len(testSyllables)
+	}
+	return word
+}
+
+// newTestCmdProcessor returns processor with rooms and n devices of different kinds in rooms
+func newTestCmdProcessor(n int) *CmdProcessor {
+	log.SetOutput(ioutil.Discard)
+
+	cmd := NewCmdProcessor()
+	for i, room := range testRooms {
+		cmd.AddLocation(i+1, room, nil)
+	}
+	for i := 0; i < n; i++ {
+		title := fmt.Sprintf("%s %s %s", testKinds[i%len(testKinds)], testWord(i), testRooms[i%len(testRooms)])
+		cmd.AddDevice(fmt.Sprintf("dev%d", i), title, "switchMultilevel", i%len(testRooms)+1, nil)
+	}
+	return cmd
+}
+
+func BenchmarkProcessPhrase(b *testing.B) {
+	cmd := newTestCmdProcessor(300)
+	// Device 17 is "подсветка" in "спальня", phrase is matched by its title
+	phrase := fmt.Sprintf("включи подсветку %s в спальне", testWord(17))
+	if devIDs, _, _ := cmd.ProcessPhrase(phrase, "check"); len(devIDs) != 1 || devIDs[0] != "dev17" {
+		b.Fatalf("'%s' is matched to %v", phrase, devIDs)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		cmd.ProcessPhrase(phrase, fmt.Sprintf("sender%d", i%10))
+	}
+}
+
+func TestConcurrentProcessPhrase(t *testing.T) {
+	cmd := newTestCmdProcessor(50)
+	phrases := []string{"включи люстру " + testWord(1) + " в спальне", "выключи торшер " + testWord(2), "включи свет на кухне"}
+	// Results of phrases processed one by one
+	want := make(map[string]string)
+	for _, phrase := range phrases {
+		devIDs, locIDs, _ := cmd.ProcessPhrase(phrase, "serial")
+		sort.Strings(devIDs)
+		want[phrase] = fmt.Sprint(devIDs, locIDs)
+	}
+
+	var wg sync.WaitGroup
+	for s := 0; s < 8; s++ {
+		wg.Add(1)
+		go func(sender string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				phrase := phrases[i%len(phrases)]
+				unlock := cmd.LockSender(sender)
+				devIDs, locIDs, _ := cmd.ProcessPhrase(phrase, sender)
+				unlock()
+				sort.Strings(devIDs)
+				if got := fmt.Sprint(devIDs, locIDs); got != want[phrase] {
+					t.Errorf("'%s' from %s: got %s, want %s", phrase, sender, got, want[phrase])
+				}
+			}
+		}(fmt.Sprintf("sender%d", s))
+	}
+	wg.Wait()
+}
+
+func TestConcurrentSync(t *testing.T) {
+	cmd := newTestCmdProcessor(0)
+	defs := [2][]CmdDeviceDef{}
+	for i := 0; i < 40; i++ {
+		def := CmdDeviceDef{fmt.Sprintf("dev%d", i), testKinds[i%len(testKinds)] + " " + testWord(i), "switchMultilevel", i%len(testRooms) + 1, nil, []string{"light"}}
+		defs[0] = append(defs[0], def)
+		// Second set has renamed and deleted devices
+		if i%2 == 0 {
+			def.Title += " новая"
+			defs[1] = append(defs[1], def)
+		}
+	}
+	locs := []CmdLocationDef{}
+	for i, room := range testRooms {
+		locs = append(locs, CmdLocationDef{i + 1, room, nil})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			cmd.Sync(locs, defs[i%2], map[string][]string{"light": {"свет"}})
+		}
+	}()
+	for s := 0; s < 4; s++ {
+		wg.Add(1)
+		go func(sender string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				cmd.ProcessPhrase("включи лампу "+testWord(i%40), sender)
+				cmd.ProcessPhrase("выключи свет в спальне", sender)
+			}
+		}(fmt.Sprintf("sender%d", s))
+	}
+	wg.Wait()
+}
+
+func TestConcurrentSaveContexts(t *testing.T) {
+	cmd := newTestCmdProcessor(50)
+	fileName := filepath.Join(t.TempDir(), "contexts.json")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := cmd.SaveContexts(fileName); err != nil {
+				t.Errorf("Can't save contexts: %s", err)
+				return
+			}
+		}
+	}()
+	for s := 0; s < 4; s++ {
+		wg.Add(1)
+		go func(sender string) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				cmd.ProcessPhrase("включи розетку "+testWord(i%50), sender)
+			}
+		}(fmt.Sprintf("sender%d", s))
+	}
+	wg.Wait()
+
+	loaded := NewCmdProcessor()
+	if err := loaded.LoadContexts(fileName); err != nil {
+		t.Fatalf("Can't load saved contexts: %s", err)
+	}
+}
+
+func TestLockSenderOrder(t *testing.T) {
+	cmd := newTestCmdProcessor(0)
+	cmd.AddLocation(1, "кухня", nil)
+	cmd.AddLocation(2, "спальня", nil)
+	cmd.AddDevice("lamp1", "лампа", "switchBinary", 1, nil)
+	cmd.AddDevice("lamp2", "лампа", "switchBinary", 2, nil)
+	cmd.SetAskAmbiguous(true)
+
+	// Question and answer must not be interleaved with other phrases of the same sender
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				unlock := cmd.LockSender("sender")
+				choices, _, cmdPtr := cmd.ProcessPhrase("включи лампу", "sender")
+				// Let other goroutines run between question and answer
+				runtime.Gosched()
+				devIDs, _, _ := cmd.ProcessPhrase("2", "sender")
+				unlock()
+				if cmdPtr != &chooseCommand || len(choices) != 2 || len(devIDs) != 1 || devIDs[0] != choices[1] {
+					t.Errorf("Choice is broken by other phrase: %v", devIDs)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
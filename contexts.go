@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// savedCommand is CommandDef with typed command data, stored in contexts file
+type savedCommand struct {
+	Words    string            `json:"words"`
+	DevTypes []string          `json:"dev_types"`
+	Command  int               `json:"command"`
+	RGB      *CommandDataRGB   `json:"rgb,omitempty"`
+	Level    *CommandDataLevel `json:"level,omitempty"`
+}
+
+// savedContext is sender context, stored in contexts file
+type savedContext struct {
+	LastCmdTime      time.Time           `json:"last_cmd_time"`
+	LastCmdLocations []int               `json:"last_cmd_locations,omitempty"`
+	LastCmdDevices   []string            `json:"last_cmd_devices,omitempty"`
+	DefaultLocation  int                 `json:"default_location"`
+	PendingDevices   []string            `json:"pending_devices,omitempty"`
+	PendingLocations []int               `json:"pending_locations,omitempty"`
+	PendingCmd       *savedCommand       `json:"pending_cmd,omitempty"`
+	PendingAt        time.Time           `json:"pending_at"`
+	PendingDuration  time.Duration       `json:"pending_duration,omitempty"`
+	UndoHistory      [][]ZWayDeviceState `json:"undo_history,omitempty"`
+}
+
+// SaveContexts writes sender contexts to file
+func (cmd *CmdProcessor) SaveContexts(fileName string) error {
+	cmd.ctxLock.Lock()
+	defer cmd.ctxLock.Unlock()
+
+	saved := make(map[string]savedContext)
+	for ctxName, ctx := range cmd.contexts {
+		ctx.lock.Lock()
+		if ctx.isEmpty() {
+			ctx.lock.Unlock()
+			continue
+		}
+		sctx := savedContext{
+			LastCmdTime:      ctx.lastCmdTime,
+			LastCmdLocations: ctx.lastCmdLocations,
+			LastCmdDevices:   ctx.lastCmdDevices,
+			DefaultLocation:  ctx.defaultLocation,
+			PendingDevices:   ctx.pendingDevices,
+			PendingLocations: ctx.pendingLocations,
+			PendingAt:        ctx.pendingAt,
+			PendingDuration:  ctx.pendingDuration,
+			UndoHistory:      append([][]ZWayDeviceState(nil), ctx.undoHistory...),
+		}
+		if ctx.pendingCmd != nil {
+			c := ctx.pendingCmd
+			sctx.PendingCmd = &savedCommand{Words: c.Words, DevTypes: c.DevTypes, Command: c.Command}
+			switch data := c.CmdData.(type) {
+			case CommandDataRGB:
+				sctx.PendingCmd.RGB = &data
+			case CommandDataLevel:
+				sctx.PendingCmd.Level = &data
+			}
+		}
+		ctx.lock.Unlock()
+		saved[ctxName] = sctx
+	}
+
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(fileName+".tmp", data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(fileName+".tmp", fileName)
+}
+
+// LoadContexts restores sender contexts from file. Expired parts of contexts are pruned
+func (cmd *CmdProcessor) LoadContexts(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	saved := make(map[string]savedContext)
+	if err = json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	cmd.lock.RLock()
+	defer cmd.lock.RUnlock()
+	cmd.ctxLock.Lock()
+	defer cmd.ctxLock.Unlock()
+
+	for ctxName, sctx := range saved {
+		ctx := &context{
+			lastCmdTime:      sctx.LastCmdTime,
+			lastCmdLocations: sctx.LastCmdLocations,
+			lastCmdDevices:   sctx.LastCmdDevices,
+			defaultLocation:  sctx.DefaultLocation,
+			pendingDevices:   sctx.PendingDevices,
+			pendingLocations: sctx.PendingLocations,
+			pendingAt:        sctx.PendingAt,
+			pendingDuration:  sctx.PendingDuration,
+			undoHistory:      sctx.UndoHistory,
+			lifetime:         cmd.contextLifetime,
+		}
+		if c := sctx.PendingCmd; c != nil {
+			ctx.pendingCmd = &CommandDef{c.Words, c.DevTypes, c.Command, nil}
+			if c.RGB != nil {
+				ctx.pendingCmd.CmdData = *c.RGB
+			} else if c.Level != nil {
+				ctx.pendingCmd.CmdData = *c.Level
+			}
+		}
+		if _, found := cmd.locations[ctx.defaultLocation]; !found {
+			ctx.defaultLocation = 0
+		}
+		ctx.prune()
+		if !ctx.isEmpty() {
+			cmd.contexts[ctxName] = ctx
+		}
+	}
+	return nil
+}
+
+// prune clears expired last command and pending choice
+func (ctx *context) prune() {
+	if ctx.isExpired() {
+		ctx.lastCmdLocations = nil
+		ctx.lastCmdDevices = nil
+		ctx.pendingDevices = nil
+		ctx.pendingLocations = nil
+		ctx.pendingCmd = nil
+		ctx.pendingAt, ctx.pendingDuration = time.Time{}, 0
+	}
+}
+
+func (ctx *context) isEmpty() bool {
+	return ctx.isExpired() && ctx.defaultLocation == 0 && len(ctx.undoHistory) == 0
+}
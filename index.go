@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"unicode/utf8"
+)
+
+// titleRef is reference to one of object's titles. Title 0 is object's title, others are aliases
+type titleRef struct {
+	id    string
+	title int
+}
+
+// titleIndex is inverted index of title stems to objects with these stems in titles.
+// Titles are stemmed once on add, so phrase matching doesn't stem titles again
+type titleIndex struct {
+	refs map[string][]titleRef
+	// Stems by length in runes, only stems of similar length are candidates for fuzzy match
+	lens map[int][]string
+}
+
+func newTitleIndex() *titleIndex {
+	return &titleIndex{refs: make(map[string][]titleRef), lens: make(map[int][]string)}
+}
+
+// add indexes object's title and aliases, which are already normalized to space separated stems
+func (idx *titleIndex) add(id string, title string, aliases []string) {
+	for i, t := range append([]string{title}, aliases...) {
+		for _, stem := range strings.Fields(t) {
+			if _, found := idx.refs[stem]; !found {
+				l := utf8.RuneCountInString(stem)
+				idx.lens[l] = append(idx.lens[l], stem)
+			}
+			idx.refs[stem] = append(idx.refs[stem], titleRef{id, i})
+		}
+	}
+}
+
+// remove deletes object's titles from index
+func (idx *titleIndex) remove(id string) {
+	for stem, refs := range idx.refs {
+		filtered := refs[:0]
+		for _, ref := range refs {
+			if ref.id != id {
+				filtered = append(filtered, ref)
+			}
+		}
+		if len(filtered) != 0 {
+			idx.refs[stem] = filtered
+			continue
+		}
+		delete(idx.refs, stem)
+		l := utf8.RuneCountInString(stem)
+		stems := idx.lens[l][:0]
+		for _, s := range idx.lens[l] {
+			if s != stem {
+				stems = append(stems, s)
+			}
+		}
+		idx.lens[l] = stems
+	}
+}
+
+// titleScores returns score of each title, matched by stemmed phrase words
+func (idx *titleIndex) titleScores(words []string) map[titleRef]int {
+	scores := make(map[titleRef]int)
+	for _, pw := range words {
+		for _, ref := range idx.refs[pw] {
+			scores[ref] += exactWordScore
+		}
+
+		pl := utf8.RuneCountInString(pw)
+		if pl < minFuzzyWordLen {
+			continue
+		}
+		// Edit distance is at least difference of lengths, so longer or shorter stems can't be similar
+		maxDiff := int(float64(pl)*(1-minFuzzySimilarity)/minFuzzySimilarity) + 1
+		for l := pl - maxDiff; l <= pl+maxDiff; l++ {
+			for _, stem := range idx.lens[l] {
+				if stem == pw {
+					continue
+				}
+				if sim := getWordSimilarity(pw, stem); sim >= minFuzzySimilarity {
+					log.Printf("Fuzzy matched '%s' to '%s', similarity=%.2f", pw, stem, sim)
+					for _, ref := range idx.refs[stem] {
+						scores[ref] += int(sim * fuzzyWordScore)
+					}
+				}
+			}
+		}
+	}
+	return scores
+}
+
+// scores returns best score of title and aliases of each object, matched by stemmed phrase words
+func (idx *titleIndex) scores(words []string) map[string]int {
+	ret := make(map[string]int)
+	for ref, score := range idx.titleScores(words) {
+		if score > ret[ref.id] {
+			ret[ref.id] = score
+		}
+	}
+	return ret
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
 var zway *ZWay
 var cmd *CmdProcessor
-var zwayURL, zwayPassword, zwayLogin, tgBotToken, listenAddr, tgBotUsers, bindLocations string
+var scheduler *Scheduler
+var scenes []Scene
+var aliases = &Aliases{}
+var askAmbiguous bool
+var contextLifetime, pollInterval time.Duration
+var zwayURL, zwayPassword, zwayLogin, tgBotToken, listenAddr, tgBotUsers, bindLocations, bindLifetimes, aliasesFile, commandsFile, tasksFile, scenesFile, classesFile, contextsFile string
 
 func main() {
 	flag.StringVar(&zwayURL, "zway-url", "http://127.0.0.1:8083/ZAutomation/api/v1", "URL to ZWay server")
@@ -21,6 +28,16 @@ func main() {
 	flag.StringVar(&tgBotToken, "tg-bot-token", "", "Telegram bot token")
 	flag.StringVar(&tgBotUsers, "tg-bot-users", "", "Comma separated telegram users, who authorized to communicate with bot")
 	flag.StringVar(&bindLocations, "bind-locations", "", "Comma separated bindings of sender's default locations, e.g 'olegator77=cabinet,192.168.1.101=hall")
+	flag.StringVar(&aliasesFile, "aliases", "", "JSON file with additional names of devices and locations")
+	flag.StringVar(&commandsFile, "commands", "", "JSON file with commands vocabulary, built-in vocabulary is used if not set")
+	flag.StringVar(&classesFile, "classes", "", "JSON file with device classes, built-in classes are used if not set")
+	flag.StringVar(&scenesFile, "scenes", "", "JSON file with scenes")
+	flag.StringVar(&contextsFile, "contexts-file", "zway-bot-contexts.json", "File to keep senders contexts across restarts")
+	flag.StringVar(&tasksFile, "tasks-file", "zway-bot-tasks.json", "File to keep pending restores of temporary commands across restarts")
+	flag.BoolVar(&askAmbiguous, "ask-ambiguous", false, "Ask to choose device, if several devices are matched by phrase")
+	flag.DurationVar(&contextLifetime, "context-lifetime", defaultContextLifetime, "Time, while last devices and locations are used for next commands")
+	flag.DurationVar(&pollInterval, "poll-interval", 5*time.Second, "Interval of polling changes of devices on ZWay server")
+	flag.StringVar(&bindLifetimes, "bind-context-lifetimes", "", "Comma separated bindings of sender's context lifetimes, e.g 'olegator77=30s,192.168.1.101=5m'")
 	flag.StringVar(&listenAddr, "http-addr", ":8000", "HTTP listen address")
 	flag.Parse()
 
@@ -41,33 +58,117 @@ func main() {
 		}
 	}
 
+	for _, ctxLifetimeBind := range strings.Split(bindLifetimes, ",") {
+		if len(ctxLifetimeBind) == 0 {
+			continue
+		}
+		lifetimeBind := strings.Split(ctxLifetimeBind, "=")
+		if len(lifetimeBind) != 2 {
+			log.Fatalf("Invalid context lifetime binding: '%s'", bindLifetimes)
+		}
+		lifetime, err := time.ParseDuration(lifetimeBind[1])
+		if err != nil {
+			log.Fatalf("Invalid context lifetime '%s' for '%s'", lifetimeBind[1], lifetimeBind[0])
+		}
+		cmd.SetSenderContextLifetime(lifetimeBind[0], lifetime)
+		log.Printf("Binding '%s' as context lifetime for '%s'", lifetime, lifetimeBind[0])
+	}
+
 	StartTgBot()
 
 	http.HandleFunc("/speech_action", func(w http.ResponseWriter, r *http.Request) {
 		phrase := r.FormValue("text")
 		log.Printf("%s -> %s\n", r.URL, phrase)
 		host, _, _ := net.SplitHostPort(r.RemoteAddr)
-		runCommand(phrase, host)
+		msg, choices := runCommand(phrase, host)
+
+		resp := HTTPResponse{Message: msg}
+		for i, choice := range choices {
+			resp.Choices = append(resp.Choices, HTTPChoice{i + 1, choice})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp)
+	})
+
+	http.HandleFunc("/tasks", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, listTasks())
+	})
+
+	http.HandleFunc("/cancel_task", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, cancelTask(r.FormValue("id")))
+	})
+
+	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		session := zway.Session()
+		w.Header().Set("Content-Type", "application/json")
+		if !session.Authorized {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(HTTPHealth{session})
 	})
 
 	http.ListenAndServe(listenAddr, nil)
 }
 
+type HTTPChoice struct {
+	ID    int    `json:"id"`
+	Title string `json:"title"`
+}
+
+// HTTPResponse is reply of /speech_action. Choices are set, if device should be clarified by sending its ID
+type HTTPResponse struct {
+	Message string       `json:"message"`
+	Choices []HTTPChoice `json:"choices,omitempty"`
+}
+
+// HTTPHealth is reply of /health endpoint
+type HTTPHealth struct {
+	ZWaySession ZWaySession `json:"zway_session"`
+}
+
 func initAll() {
 	zway = NewZWay(zwayURL)
 	cmd = NewCmdProcessor()
+	cmd.SetAskAmbiguous(askAmbiguous)
+	cmd.SetContextLifetime(contextLifetime)
+	scheduler = NewScheduler(tasksFile, restoreLevels)
 
 	if err := zway.Auth(zwayLogin, zwayPassword); err != nil {
 		log.Fatalf("Can't auth to zway: %s", err.Error())
 	}
 
+	if len(commandsFile) != 0 {
+		commands, err := LoadCommands(commandsFile)
+		if err != nil {
+			log.Fatalf("Can't load commands: %s", err.Error())
+		}
+		cmd.SetCommands(commands)
+		log.Printf("Loaded %d commands from '%s'", len(commands), commandsFile)
+	}
+
+	if len(classesFile) != 0 {
+		classes, err := LoadDeviceClasses(classesFile)
+		if err != nil {
+			log.Fatalf("Can't load device classes: %s", err.Error())
+		}
+		cmd.SetDeviceClasses(classes)
+		log.Printf("Loaded %d device classes from '%s'", len(classes), classesFile)
+	}
+
+	if len(aliasesFile) != 0 {
+		var err error
+		if aliases, err = LoadAliases(aliasesFile); err != nil {
+			log.Fatalf("Can't load aliases: %s", err.Error())
+		}
+	}
+
 	locations, err := zway.Locations(false)
 	if err != nil {
 		log.Fatalf("Can't get locations from zway: %s", err.Error())
 	}
 
 	for _, loc := range locations {
-		title := cmd.AddLocation(loc.ID, loc.Title)
+		title := cmd.AddLocation(loc.ID, loc.Title, aliases.Locations[strconv.Itoa(loc.ID)])
 		log.Printf("%-4d %-10s (name=%s)\n", loc.ID, title, loc.Title)
 	}
 
@@ -77,16 +178,120 @@ func initAll() {
 	}
 
 	for _, d := range devices {
-		title := cmd.AddDevice(d.ID, d.Metrics.Title, d.DeviceType, d.Location)
-		log.Printf("%-27s %-17s %-10s %-16s (name='%s' lvl=%d)", d.ID, d.DeviceType, cmd.GetLocationTitle(d.Location), title, d.Metrics.Title, int(d.Metrics.Level))
+		title := cmd.AddDevice(d.ID, d.Metrics.Title, d.DeviceType, d.Location, deviceAliases(d))
+		for _, tag := range d.Tags {
+			cmd.AddDeviceTag(d.ID, tag, aliases.Tags[tag])
+		}
+		log.Printf("%-27s %-17s %-10s %-16s (name='%s' lvl=%d tags=%v)", d.ID, d.DeviceType, cmd.GetLocationTitle(d.Location), title, d.Metrics.Title, int(d.Metrics.Level), d.Tags)
+	}
+
+	if len(scenesFile) != 0 {
+		if scenes, err = LoadScenes(scenesFile); err != nil {
+			log.Fatalf("Can't load scenes: %s", err.Error())
+		}
 	}
 
-	zway.StartPolling(time.Duration(30 * time.Second))
+	for _, scene := range scenes {
+		for _, devID := range scene.Devices() {
+			if _, found := zway.Device(devID); !found {
+				log.Fatalf("Can't add scene '%s': Not found device '%s'", scene.Name, devID)
+			}
+		}
+		title := cmd.AddScene(scene.Name, scene.Aliases)
+		log.Printf("Scene %-16s (name='%s' steps=%d)", title, scene.Name, len(scene.Steps))
+	}
+
+	if err := cmd.LoadContexts(contextsFile); err != nil {
+		log.Printf("Can't load contexts: %s", err.Error())
+	}
+
+	if err := scheduler.LoadState(); err != nil {
+		log.Printf("Can't load scheduled tasks: %s", err.Error())
+	}
+
+	zway.Subscribe(syncDevices)
+	zway.StartPolling(pollInterval)
 }
 
-func runCommand(phrase string, ctxName string) (msg string) {
+// deviceAliases returns aliases of device from aliases file and names of sensor's probe
+func deviceAliases(d ZWayDevice) []string {
+	devAliases := append([]string{}, aliases.Devices[d.ID]...)
+	if len(d.ProbeType) != 0 {
+		devAliases = append(devAliases, sensorProbeNames[d.ProbeType]...)
+	}
+	return devAliases
+}
 
-	devIDs, locIDs, cmd := cmd.ProcessPhrase(phrase, ctxName)
+// syncDevices updates devices and locations of command processor, when they are changed on ZWay server
+func syncDevices(events []ZWayEvent) {
+	locations, err := zway.Locations(false)
+	if err != nil {
+		log.Printf("Can't get locations from zway: %s", err.Error())
+		return
+	}
+	devices, err := zway.Devices(false)
+	if err != nil {
+		log.Printf("Can't get devices from zway: %s", err.Error())
+		return
+	}
+
+	locDefs := []CmdLocationDef{}
+	for _, loc := range locations {
+		locDefs = append(locDefs, CmdLocationDef{loc.ID, loc.Title, aliases.Locations[strconv.Itoa(loc.ID)]})
+	}
+	devDefs := []CmdDeviceDef{}
+	for _, d := range devices {
+		devDefs = append(devDefs, CmdDeviceDef{d.ID, d.Metrics.Title, d.DeviceType, d.Location, deviceAliases(d), d.Tags})
+	}
+
+	if cmd.Sync(locDefs, devDefs, aliases.Tags) == 0 {
+		return
+	}
+
+	for _, scene := range scenes {
+		for _, devID := range scene.Devices() {
+			if !cmd.HasDevice(devID) {
+				log.Printf("Scene '%s' has deleted device '%s'", scene.Name, devID)
+			}
+		}
+	}
+}
+
+// runCommand executes phrase. Returns reply and titles of devices to choose from, if phrase is ambiguous
+func runCommand(phrase string, ctxName string) (msg string, choices []string) {
+	defer cmd.LockSender(ctxName)()
+
+	for i, clause := range cmd.SplitClauses(phrase) {
+		if i != 0 {
+			msg += "\n"
+		}
+		clauseMsg, clauseChoices := runClause(clause, ctxName)
+		msg += clauseMsg
+		if len(clauseChoices) != 0 {
+			choices = clauseChoices
+		}
+	}
+	if len(msg) == 0 {
+		msg = fmt.Sprintf("Не понял команду")
+	}
+
+	if err := cmd.SaveContexts(contextsFile); err != nil {
+		log.Printf("Can't save contexts: %s", err.Error())
+	}
+	return msg, choices
+}
+
+func runClause(phrase string, ctxName string) (msg string, choices []string) {
+
+	at, phrase, delayed := parseTime(phrase, time.Now())
+	duration, phrase, temporary := parseDuration(phrase)
+
+	devIDs, locIDs, cmd, usedContext := processPhrase(phrase, ctxName)
+	if chosenAt, chosenDuration := chosenSchedule(ctxName); !chosenAt.IsZero() || chosenDuration != 0 {
+		// Device of delayed or temporary command is chosen, e.g. "2" after "turn on the lamp for 20 minutes"
+		at, delayed = chosenAt, !chosenAt.IsZero()
+		duration, temporary = chosenDuration, chosenDuration != 0
+	}
 	devNames := ""
 	for i, devID := range devIDs {
 		if i != 0 {
@@ -103,40 +308,339 @@ func runCommand(phrase string, ctxName string) (msg string) {
 		locNames += zway.LocationTitle(locID)
 	}
 
+	if cmd != nil && cmd.Command == CommandUndo {
+		return runUndo(ctxName), nil
+	}
+
+	if cmd != nil && cmd.Command == CommandReset {
+		log.Printf("Context %s is reset", ctxName)
+		return "Контекст сброшен", nil
+	}
+
+	if cmd != nil && cmd.Command == CommandScene {
+		scene := findScene(cmd.CmdData.(string))
+		if delayed {
+			title := fmt.Sprintf("сцена %s", scene.Name)
+			task := scheduler.Schedule(at, ctxName, title, func() {
+				log.Printf("Running scheduled task '%s' in ctx %s", title, ctxName)
+				saveUndo(scene.Devices(), ctxName)
+				runScene(scene, ctxName)
+			})
+			return fmt.Sprintf("Запланировано #%d в %s: %s", task.ID, formatTime(at), title), nil
+		}
+		saveUndo(scene.Devices(), ctxName)
+		go runScene(scene, ctxName)
+		return fmt.Sprintf("Запускаю сцену %s", scene.Name), nil
+	}
+
+	if cmd == nil && len(devIDs) == 0 {
+		log.Printf("Can't execute action")
+		return fmt.Sprintf("Не понял команду"), nil
+	}
+
+	if cmd != nil && cmd.Command == CommandQuery {
+		for i, devID := range devIDs {
+			if i != 0 {
+				msg += "\n"
+			}
+			msg += describeDevice(devID)
+		}
+		return msg, nil
+	}
+
+	if cmd != nil && cmd.Command == CommandChoose {
+		msg = "Уточните, какое устройство:"
+		for i, devID := range devIDs {
+			d, _ := zway.Device(devID)
+			choice := fmt.Sprintf("%s (%s)", d.Metrics.Title, zway.LocationTitle(d.Location))
+			msg += fmt.Sprintf("\n%d. %s", i+1, choice)
+			choices = append(choices, choice)
+		}
+		if delayed || temporary {
+			setPendingSchedule(ctxName, at, duration, delayed)
+		}
+		return msg, choices
+	}
+
+	if delayed {
+		title := fmt.Sprintf("переключить %s", devNames)
+		if cmd != nil {
+			title = fmt.Sprintf("%s на %s", cmd.Words, devNames)
+		}
+		task := scheduler.Schedule(at, ctxName, title, func() {
+			log.Printf("Running scheduled task '%s' in ctx %s", title, ctxName)
+			saveUndo(devIDs, ctxName)
+			applyCommand(devIDs, cmd, ctxName)
+		})
+		log.Printf("Scheduled task #%d '%s' at %s in ctx %s", task.ID, title, at, ctxName)
+		return fmt.Sprintf("Запланировано #%d в %s: %s", task.ID, formatTime(at), title), nil
+	}
+
+	if temporary {
+		return runTemporary(devIDs, cmd, duration, devNames, ctxName), nil
+	}
+
 	if cmd != nil {
-		msg = fmt.Sprintf("Выполняю %s на %s", cmd.Words, devNames)
+		switch cmd.Command {
+		case CommandDimmerLevel:
+			msg = fmt.Sprintf("Устанавливаю уровень %d на %s", cmd.CmdData.(CommandDataLevel).Level, devNames)
+		case CommandThermostatUp, CommandThermostatDown, CommandThermostatLevel:
+			msg = fmt.Sprintf("Меняю температуру на %s", devNames)
+		default:
+			msg = fmt.Sprintf("Выполняю %s на %s", cmd.Words, devNames)
+		}
 		if len(locNames) != 0 {
 			msg += fmt.Sprintf(" в %s", locNames)
 		}
+	} else {
+		msg = fmt.Sprintf("Переключаю %s", devNames)
+	}
+	if usedContext {
+		msg += " (из контекста)"
+	}
 
-		log.Printf("Applying command '%s' to device: '%s' in ctx %s", cmd.Words, devNames, ctxName)
+	saveUndo(devIDs, ctxName)
+	return msg + applyCommand(devIDs, cmd, ctxName), nil
+}
 
-		for _, devID := range devIDs {
-			switch cmd.Command {
-			case CommandOn:
-				zway.ControlOn(devID)
-			case CommandOff:
-				zway.ControlOff(devID)
-			case CommandRGB:
-				rgb := cmd.CmdData.(CommandDataRGB)
-				zway.ControlRGB(devID, rgb.R, rgb.G, rgb.B)
-			case CommandDimmerDown:
-				zway.ControlDimmerDown(devID)
-			case CommandDimmerUp:
-				zway.ControlDimmerUp(devID)
-			case CommandDimmerMax:
-				zway.ControlDimmerMax(devID)
-			}
+// processPhrase processes phrase and also returns, if sender's context was used
+func processPhrase(phrase string, ctxName string) ([]string, []int, *CommandDef, bool) {
+	devIDs, locIDs, cmdDef := cmd.ProcessPhrase(phrase, ctxName)
+	return devIDs, locIDs, cmdDef, cmd.IsContextUsed(ctxName)
+}
+
+func chosenSchedule(ctxName string) (time.Time, time.Duration) {
+	return cmd.ChosenSchedule(ctxName)
+}
+
+// setPendingSchedule keeps time of delayed or duration of temporary command until user chooses device
+func setPendingSchedule(ctxName string, at time.Time, duration time.Duration, delayed bool) {
+	if !delayed {
+		at = time.Time{}
+	}
+	cmd.SetPendingSchedule(ctxName, at, duration)
+}
+
+// runTemporary applies command (or turns devices on if cmd is nil) and schedules restore of previous device levels
+func runTemporary(devIDs []string, cmd *CommandDef, duration time.Duration, devNames, ctxName string) string {
+	levels := make(map[string]int)
+	for _, devID := range devIDs {
+		levels[devID] = zway.DeviceLevel(devID)
+	}
+
+	title := fmt.Sprintf("вернуть %s", devNames)
+	at := time.Now().Add(duration)
+	task := scheduler.ScheduleRestore(at, ctxName, title, levels)
+	log.Printf("Scheduled restore #%d of '%s' at %s in ctx %s", task.ID, devNames, at, ctxName)
+
+	if cmd == nil {
+		cmd = &CommandDef{"on", []string{"*"}, CommandOn, nil}
+	}
+	saveUndo(devIDs, ctxName)
+	details := applyCommand(devIDs, cmd, ctxName)
+
+	return fmt.Sprintf("Выполняю %s на %s до %s (#%d)", cmd.Words, devNames, formatTime(at), task.ID) + details
+}
+
+// runUndo restores states of devices before last command of sender
+func runUndo(ctxName string) string {
+	states := cmd.PopUndo(ctxName)
+	if len(states) == 0 {
+		return "Нечего отменять"
+	}
+
+	devNames := ""
+	for i, state := range states {
+		if i != 0 {
+			devNames += ","
 		}
-	} else if len(devIDs) != 0 {
-		msg = fmt.Sprintf("Переключаю %s", devNames)
-		log.Printf("Applying default command to device: '%s' in ctx %s", devNames, ctxName)
+		devNames += zway.DeviceTitle(state.ID)
+		log.Printf("Undo: restoring level %d of '%s' in ctx %s", state.Level, zway.DeviceTitle(state.ID), ctxName)
+		zway.RestoreState(state)
+	}
+	return fmt.Sprintf("Отменяю команду на %s", devNames)
+}
+
+func findScene(name string) *Scene {
+	for i := range scenes {
+		if scenes[i].Name == name {
+			return &scenes[i]
+		}
+	}
+	return nil
+}
+
+// runScene applies scene steps in order, waiting for step delays
+func runScene(scene *Scene, ctxName string) {
+	log.Printf("Running scene '%s' in ctx %s", scene.Name, ctxName)
+	for _, step := range scene.Steps {
+		if step.delay > 0 {
+			time.Sleep(step.delay)
+		}
+		cmdDef := step.cmdDef
+		applyCommand([]string{step.Device}, &cmdDef, ctxName)
+	}
+}
+
+func listScenes() (msg string) {
+	for _, scene := range scenes {
+		msg += scene.Name
+		if len(scene.Aliases) != 0 {
+			msg += " (" + strings.Join(scene.Aliases, ", ") + ")"
+		}
+		msg += "\n"
+	}
+	if len(msg) == 0 {
+		msg = "Нет сцен"
+	}
+	return msg
+}
+
+// saveUndo saves current states of devices to sender's undo history
+func saveUndo(devIDs []string, ctxName string) {
+	states := make([]ZWayDeviceState, 0, len(devIDs))
+	for _, devID := range devIDs {
+		states = append(states, zway.DeviceState(devID))
+	}
+	cmd.PushUndo(ctxName, states)
+}
+
+func restoreLevels(levels map[string]int) {
+	for devID, level := range levels {
+		log.Printf("Restoring level %d of '%s'", level, zway.DeviceTitle(devID))
+		zway.ControlLevel(devID, level)
+	}
+}
+
+// applyCommand applies command to devices, or toggles devices if cmd is nil.
+// Returns details of changed device states
+func applyCommand(devIDs []string, cmd *CommandDef, ctxName string) (details string) {
+
+	if cmd == nil {
+		log.Printf("Applying default command to devices: '%v' in ctx %s", devIDs, ctxName)
 		for _, devID := range devIDs {
 			zway.ControlToggle(devID)
 		}
-	} else {
-		msg = fmt.Sprintf("Не понял команду")
-		log.Printf("Can't execute action")
+		return ""
+	}
+
+	log.Printf("Applying command '%s' to devices: '%v' in ctx %s", cmd.Words, devIDs, ctxName)
+
+	for _, devID := range devIDs {
+		oldLevel := zway.DeviceLevel(devID)
+		switch cmd.Command {
+		case CommandOn:
+			zway.ControlOn(devID)
+		case CommandOff:
+			zway.ControlOff(devID)
+		case CommandToggle:
+			zway.ControlToggle(devID)
+		case CommandRGB:
+			rgb := cmd.CmdData.(CommandDataRGB)
+			zway.ControlRGB(devID, rgb.R, rgb.G, rgb.B)
+		case CommandDimmerDown:
+			zway.ControlDimmerDown(devID)
+		case CommandDimmerUp:
+			zway.ControlDimmerUp(devID)
+		case CommandDimmerMax:
+			zway.ControlDimmerMax(devID)
+		case CommandDimmerLevel:
+			zway.ControlDimmer(devID, cmd.CmdData.(CommandDataLevel).Level)
+		case CommandThermostatUp:
+			zway.ControlThermostatUp(devID)
+		case CommandThermostatDown:
+			zway.ControlThermostatDown(devID)
+		case CommandThermostatLevel:
+			zway.ControlThermostat(devID, cmd.CmdData.(CommandDataLevel).Level)
+		}
+		switch cmd.Command {
+		case CommandThermostatUp, CommandThermostatDown, CommandThermostatLevel:
+			details += fmt.Sprintf("\n%s: %d° -> %d°", zway.DeviceTitle(devID), oldLevel, zway.DeviceLevel(devID))
+		}
+	}
+	return details
+}
+
+// describeDevice returns cached device state
+func describeDevice(devID string) string {
+	d, found := zway.Device(devID)
+	if !found {
+		return fmt.Sprintf("%s: нет данных", devID)
+	}
+
+	state := "выключен"
+	if d.Metrics.Level != 0 {
+		state = "включен"
+	}
+
+	switch d.DeviceType {
+	case "switchMultilevel":
+		if d.Metrics.Level != 0 {
+			state += fmt.Sprintf(", уровень %d%%", int(d.Metrics.Level))
+		}
+	case "switchRGBW":
+		if d.Metrics.Level != 0 {
+			state += fmt.Sprintf(", цвет %d,%d,%d", d.Metrics.Color.R, d.Metrics.Color.G, d.Metrics.Color.B)
+		}
+	case "thermostat":
+		state = fmt.Sprintf("температура %d°", int(d.Metrics.Level))
+	case "toggleButton":
+		state = "сцена"
+	case "sensorMultilevel", "sensorBinary":
+		state = formatDeviceLevel(d)
+	}
+	return fmt.Sprintf("%s: %s", d.Metrics.Title, state)
+}
+
+// formatDeviceLevel returns device level with units
+func formatDeviceLevel(d ZWayDevice) string {
+	switch d.DeviceType {
+	case "sensorMultilevel":
+		return strings.TrimSpace(fmt.Sprintf("%s %s", strconv.FormatFloat(float64(d.Metrics.Level), 'f', -1, 64), d.Metrics.ScaleTitle))
+	case "sensorBinary":
+		on := d.Metrics.Level != 0
+		switch {
+		case d.ProbeType == "motion" && on:
+			return "есть движение"
+		case d.ProbeType == "motion":
+			return "нет движения"
+		case d.ProbeType == "door-window" && on:
+			return "открыто"
+		case d.ProbeType == "door-window":
+			return "закрыто"
+		case on:
+			return "сработал"
+		}
+		return "не сработал"
+	}
+	return strconv.Itoa(int(d.Metrics.Level))
+}
+
+func listTasks() (msg string) {
+	for _, task := range scheduler.Tasks() {
+		msg += fmt.Sprintf("#%d %s: %s (%s)\n", task.ID, formatTime(task.At), task.Title, task.CtxName)
+	}
+	if len(msg) == 0 {
+		msg = "Нет запланированных команд"
 	}
 	return msg
 }
+
+func cancelTask(idStr string) string {
+	id, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(idStr), "#"))
+	if err != nil {
+		return fmt.Sprintf("Неверный номер команды '%s'", idStr)
+	}
+	if !scheduler.Cancel(id) {
+		return fmt.Sprintf("Не найдена команда #%d", id)
+	}
+	log.Printf("Canceled scheduled task #%d", id)
+	return fmt.Sprintf("Команда #%d отменена", id)
+}
+
+func formatTime(t time.Time) string {
+	if y, m, d := t.Date(); y == time.Now().Year() && m == time.Now().Month() && d == time.Now().Day() {
+		return t.Format("15:04")
+	}
+	return t.Format("02.01 15:04")
+}
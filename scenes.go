@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Scene is named list of device commands, defined in scenes file
+type Scene struct {
+	Name    string      `json:"name"`
+	Aliases []string    `json:"aliases"`
+	Steps   []SceneStep `json:"steps"`
+}
+
+type SceneStep struct {
+	Device  string          `json:"device"`
+	Command string          `json:"command"`
+	RGB     *CommandDataRGB `json:"rgb,omitempty"`
+	Level   *int            `json:"level,omitempty"`
+	// Delay before step, e.g. "30s" or "5m"
+	Delay string `json:"delay,omitempty"`
+
+	cmdDef CommandDef
+	delay  time.Duration
+}
+
+func LoadScenes(fileName string) ([]Scene, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scenes := []Scene{}
+	if err = json.NewDecoder(f).Decode(&scenes); err != nil {
+		return nil, fmt.Errorf("Can't parse '%s': %s", fileName, err.Error())
+	}
+
+	for i := range scenes {
+		scene := &scenes[i]
+		if len(splitPhrase(scene.Name)) == 0 {
+			return nil, fmt.Errorf("Invalid scene #%d in '%s': No name", i+1, fileName)
+		}
+		if len(scene.Steps) == 0 {
+			return nil, fmt.Errorf("Invalid scene '%s' in '%s': No steps", scene.Name, fileName)
+		}
+		for j := range scene.Steps {
+			if err := scene.Steps[j].parse(); err != nil {
+				return nil, fmt.Errorf("Invalid step #%d of scene '%s' in '%s': %s", j+1, scene.Name, fileName, err.Error())
+			}
+		}
+	}
+	return scenes, nil
+}
+
+func (step *SceneStep) parse() (err error) {
+	if len(step.Device) == 0 {
+		return fmt.Errorf("No device")
+	}
+
+	step.cmdDef = CommandDef{Words: step.Command, DevTypes: []string{"*"}}
+	if step.cmdDef.Command, step.cmdDef.CmdData, err = parseCommandName(step.Command, step.RGB, step.Level); err != nil {
+		return err
+	}
+	if step.cmdDef.Command == CommandUndo || step.cmdDef.Command == CommandReset {
+		return fmt.Errorf("Command '%s' can't be scene step", step.Command)
+	}
+
+	if len(step.Delay) != 0 {
+		if step.delay, err = time.ParseDuration(step.Delay); err != nil {
+			return fmt.Errorf("Invalid delay '%s'", step.Delay)
+		}
+	}
+	return nil
+}
+
+// Devices returns IDs of all devices, used by scene
+func (scene *Scene) Devices() (devIDs []string) {
+	used := make(map[string]bool)
+	for _, step := range scene.Steps {
+		if _, found := used[step.Device]; !found {
+			used[step.Device] = true
+			devIDs = append(devIDs, step.Device)
+		}
+	}
+	return devIDs
+}
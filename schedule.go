@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Relative time expressions, e.g. "через 10 минут", "in half an hour"
+var reRelativeTime = regexp.MustCompile(`(?:^|\s)(?:через|in)\s+(\d+|полчаса|half an hour|an hour|a minute|час|минуту)\s*` +
+	`(секунд[уы]?|сек|seconds?|secs?|минут[уы]?|мин|minutes?|mins?|час(?:а|ов)?|hours?)?(?:\s|$)`)
+
+// Durations of temporary commands, e.g. "на 20 минут", "for half an hour"
+var reDuration = regexp.MustCompile(`(?:^|\s)(?:на|for)\s+(\d+|полчаса|half an hour|an hour|a minute|час|минуту)\s*` +
+	`(секунд[уы]?|сек|seconds?|secs?|минут[уы]?|мин|minutes?|mins?|час(?:а|ов)?|hours?)?(?:\s|$)`)
+
+// Absolute time expressions, e.g. "at 23:00", "в 7 утра"
+var reAbsoluteTime = regexp.MustCompile(`(?:^|\s)(?:в|at)\s+(\d{1,2})(?:[:.](\d{2}))?\s*` +
+	`(утра|дня|вечера|ночи|am|pm|часов|часа|час|o'clock)?(?:\s|$)`)
+
+type ScheduledTask struct {
+	ID      int       `json:"id"`
+	At      time.Time `json:"at"`
+	CtxName string    `json:"ctx_name"`
+	Title   string    `json:"title"`
+	// Device levels to restore. Only restore tasks are saved to state file
+	Levels map[string]int `json:"levels,omitempty"`
+	timer  *time.Timer
+}
+
+type Scheduler struct {
+	tasks     map[int]*ScheduledTask
+	nextID    int
+	stateFile string
+	restore   func(levels map[string]int)
+	lock      sync.Mutex
+}
+
+func NewScheduler(stateFile string, restore func(levels map[string]int)) *Scheduler {
+	return &Scheduler{tasks: make(map[int]*ScheduledTask), stateFile: stateFile, restore: restore}
+}
+
+func (s *Scheduler) Schedule(at time.Time, ctxName, title string, action func()) ScheduledTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nextID++
+	task := &ScheduledTask{ID: s.nextID, At: at, CtxName: ctxName, Title: title}
+	s.add(task, action)
+	return *task
+}
+
+// ScheduleRestore schedules restore of device levels. Task is kept in state file until it is done
+func (s *Scheduler) ScheduleRestore(at time.Time, ctxName, title string, levels map[string]int) ScheduledTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nextID++
+	task := &ScheduledTask{ID: s.nextID, At: at, CtxName: ctxName, Title: title, Levels: levels}
+	s.add(task, func() { s.restore(levels) })
+	s.save()
+	return *task
+}
+
+// LoadState reschedules restore tasks from state file
+func (s *Scheduler) LoadState() error {
+	data, err := ioutil.ReadFile(s.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	tasks := []*ScheduledTask{}
+	if err = json.Unmarshal(data, &tasks); err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, task := range tasks {
+		levels := task.Levels
+		if task.ID > s.nextID {
+			s.nextID = task.ID
+		}
+		log.Printf("Restored scheduled task #%d '%s' at %s", task.ID, task.Title, task.At)
+		s.add(task, func() { s.restore(levels) })
+	}
+	return nil
+}
+
+func (s *Scheduler) add(task *ScheduledTask, action func()) {
+	id := task.ID
+	task.timer = time.AfterFunc(task.At.Sub(time.Now()), func() {
+		s.lock.Lock()
+		_, found := s.tasks[id]
+		delete(s.tasks, id)
+		if found && task.Levels != nil {
+			s.save()
+		}
+		s.lock.Unlock()
+		if found {
+			action()
+		}
+	})
+	s.tasks[id] = task
+}
+
+// save writes restore tasks to state file. Must be called with lock held
+func (s *Scheduler) save() {
+	if len(s.stateFile) == 0 {
+		return
+	}
+	tasks := []*ScheduledTask{}
+	for _, task := range s.tasks {
+		if task.Levels != nil {
+			tasks = append(tasks, task)
+		}
+	}
+	data, _ := json.Marshal(tasks)
+	// Write to temporary file first, so crash during write doesn't lose saved tasks
+	err := ioutil.WriteFile(s.stateFile+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(s.stateFile+".tmp", s.stateFile)
+	}
+	if err != nil {
+		log.Printf("Can't save scheduled tasks: %s", err.Error())
+	}
+}
+
+// Tasks returns pending tasks, ordered by time
+func (s *Scheduler) Tasks() (ret []ScheduledTask) {
+	s.lock.Lock()
+	for _, task := range s.tasks {
+		ret = append(ret, *task)
+	}
+	s.lock.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].At.Before(ret[j].At) })
+	return ret
+}
+
+func (s *Scheduler) Cancel(id int) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	task, found := s.tasks[id]
+	if found {
+		task.timer.Stop()
+		delete(s.tasks, id)
+		if task.Levels != nil {
+			s.save()
+		}
+	}
+	return found
+}
+
+// parseTime looks up time expression in phrase.
+// Returns resolved time and phrase without time expression
+func parseTime(phrase string, now time.Time) (time.Time, string, bool) {
+	lphrase := strings.ToLower(phrase)
+
+	// Bare number after "через"/"in" is level, e.g. "dimmer in 40"
+	if m := reRelativeTime.FindStringSubmatchIndex(lphrase); m != nil && (m[4] >= 0 || len(strings.Trim(lphrase[m[2]:m[3]], "0123456789")) != 0) {
+		return now.Add(getSubmatchDuration(lphrase, m)), lphrase[:m[0]] + " " + lphrase[m[1]:], true
+	}
+
+	if m := reAbsoluteTime.FindStringSubmatchIndex(lphrase); m != nil {
+		hour, _ := strconv.Atoi(lphrase[m[2]:m[3]])
+		minute, suffix := 0, ""
+		if m[4] >= 0 {
+			minute, _ = strconv.Atoi(lphrase[m[4]:m[5]])
+		}
+		if m[6] >= 0 {
+			suffix = lphrase[m[6]:m[7]]
+		}
+
+		// Bare number after "в"/"at" is more likely level, than time
+		if m[4] < 0 && len(suffix) == 0 {
+			return now, phrase, false
+		}
+
+		switch suffix {
+		case "дня", "вечера", "pm":
+			if hour < 12 {
+				hour += 12
+			}
+		case "ночи", "am":
+			if hour == 12 {
+				hour = 0
+			}
+		}
+		if hour > 23 || minute > 59 {
+			return now, phrase, false
+		}
+
+		at := time.Date(now.Year(), now.Month(), now.Day(), hour, minute, 0, 0, now.Location())
+		if !at.After(now) {
+			at = at.AddDate(0, 0, 1)
+		}
+		return at, lphrase[:m[0]] + " " + lphrase[m[1]:], true
+	}
+
+	return now, phrase, false
+}
+
+// parseDuration looks up duration of temporary command in phrase.
+// Returns duration and phrase without duration expression
+func parseDuration(phrase string) (time.Duration, string, bool) {
+	lphrase := strings.ToLower(phrase)
+
+	m := reDuration.FindStringSubmatchIndex(lphrase)
+	// Bare number after "на"/"for" is level, e.g. "dimmer на 40"
+	if m == nil || (m[4] < 0 && len(strings.Trim(lphrase[m[2]:m[3]], "0123456789")) == 0) {
+		return 0, phrase, false
+	}
+	return getSubmatchDuration(lphrase, m), lphrase[:m[0]] + " " + lphrase[m[1]:], true
+}
+
+// getSubmatchDuration converts number and unit submatches of reRelativeTime or reDuration to duration
+func getSubmatchDuration(lphrase string, m []int) time.Duration {
+	num, unit := lphrase[m[2]:m[3]], ""
+	if m[4] >= 0 {
+		unit = lphrase[m[4]:m[5]]
+	}
+
+	switch num {
+	case "полчаса", "half an hour":
+		return 30 * time.Minute
+	case "час", "an hour":
+		return time.Hour
+	case "минуту", "a minute":
+		return time.Minute
+	}
+
+	n, _ := strconv.Atoi(num)
+	switch {
+	case strings.HasPrefix(unit, "сек"), strings.HasPrefix(unit, "sec"):
+		return time.Duration(n) * time.Second
+	case strings.HasPrefix(unit, "час"), strings.HasPrefix(unit, "hour"):
+		return time.Duration(n) * time.Hour
+	}
+	return time.Duration(n) * time.Minute
+}
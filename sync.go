@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+)
+
+// CmdLocationDef is location, passed to Sync
+type CmdLocationDef struct {
+	ID      int
+	Title   string
+	Aliases []string
+}
+
+// CmdDeviceDef is device, passed to Sync
+type CmdDeviceDef struct {
+	ID       string
+	Title    string
+	DevType  string
+	Location int
+	Aliases  []string
+	Tags     []string
+}
+
+// Sync atomically replaces locations, devices and groups by actual ones, logs changes and returns number of changes.
+// Scenes are kept, and deleted devices and locations are removed from contexts
+func (cmd *CmdProcessor) Sync(locations []CmdLocationDef, devices []CmdDeviceDef, tagAliases map[string][]string) int {
+	next := &CmdProcessor{
+		locations:  make(map[int]CmdLocation),
+		devices:    make(map[string]CmdDevice),
+		locNames:   make(map[string]int),
+		groups:     make(map[string]*CmdGroup),
+		devIndex:   newTitleIndex(),
+		locIndex:   newTitleIndex(),
+		groupIndex: newTitleIndex(),
+	}
+	for _, loc := range locations {
+		next.addLocation(loc.ID, loc.Title, loc.Aliases)
+	}
+	for _, d := range devices {
+		next.addDevice(d.ID, d.Title, d.DevType, d.Location, d.Aliases)
+		for _, tag := range d.Tags {
+			next.addDeviceTag(d.ID, tag, tagAliases[tag])
+		}
+	}
+
+	cmd.lock.Lock()
+	defer cmd.lock.Unlock()
+
+	changes := 0
+	for id, loc := range next.locations {
+		if old, found := cmd.locations[id]; !found {
+			log.Printf("Added location %d '%s'", id, loc.Title)
+			changes++
+		} else if old.Title != loc.Title {
+			log.Printf("Renamed location %d '%s' -> '%s'", id, old.Title, loc.Title)
+			changes++
+		}
+	}
+	for id, loc := range cmd.locations {
+		if _, found := next.locations[id]; !found {
+			log.Printf("Deleted location %d '%s'", id, loc.Title)
+			changes++
+		}
+	}
+
+	for id, dev := range next.devices {
+		old, found := cmd.devices[id]
+		if !found {
+			log.Printf("Added device '%s' '%s' in '%s'", id, dev.Title, next.locations[dev.IDLocation].Title)
+			changes++
+			continue
+		}
+		if old.Title != dev.Title {
+			log.Printf("Renamed device '%s' '%s' -> '%s'", id, old.Title, dev.Title)
+			changes++
+		}
+		if old.IDLocation != dev.IDLocation {
+			log.Printf("Moved device '%s' '%s' from '%s' to '%s'", id, dev.Title, cmd.locations[old.IDLocation].Title, next.locations[dev.IDLocation].Title)
+			changes++
+		}
+		if old.DevType != dev.DevType {
+			log.Printf("Changed type of device '%s' '%s' from '%s' to '%s'", id, dev.Title, old.DevType, dev.DevType)
+			changes++
+		}
+		if strings.Join(old.Tags, ",") != strings.Join(dev.Tags, ",") {
+			log.Printf("Changed tags of device '%s' '%s' from %v to %v", id, dev.Title, old.Tags, dev.Tags)
+			changes++
+		}
+	}
+	for id, dev := range cmd.devices {
+		if _, found := next.devices[id]; !found {
+			log.Printf("Deleted device '%s' '%s'", id, dev.Title)
+			changes++
+		}
+	}
+
+	if changes == 0 {
+		return 0
+	}
+
+	cmd.locations, cmd.devices, cmd.locNames, cmd.groups = next.locations, next.devices, next.locNames, next.groups
+	cmd.devIndex, cmd.locIndex, cmd.groupIndex = next.devIndex, next.locIndex, next.groupIndex
+
+	cmd.ctxLock.Lock()
+	for _, ctx := range cmd.contexts {
+		ctx.lock.Lock()
+		ctx.forgetDeleted(cmd.devices, cmd.locations)
+		ctx.lock.Unlock()
+	}
+	cmd.ctxLock.Unlock()
+
+	log.Printf("Synced %d locations and %d devices, %d changes", len(cmd.locations), len(cmd.devices), changes)
+	return changes
+}
+
+// forgetDeleted removes devices and locations, which are not exist anymore, from context
+func (ctx *context) forgetDeleted(devices map[string]CmdDevice, locations map[int]CmdLocation) {
+	filterDevs := func(devIDs []string) []string {
+		ret := []string{}
+		for _, id := range devIDs {
+			if _, found := devices[id]; found {
+				ret = append(ret, id)
+			}
+		}
+		return ret
+	}
+	filterLocs := func(locIDs []int) []int {
+		ret := []int{}
+		for _, id := range locIDs {
+			if _, found := locations[id]; found || id == 0 {
+				ret = append(ret, id)
+			}
+		}
+		return ret
+	}
+
+	ctx.lastCmdDevices = filterDevs(ctx.lastCmdDevices)
+	ctx.lastCmdLocations = filterLocs(ctx.lastCmdLocations)
+	// Choice is answered by number, so it is dropped, if any of devices was deleted
+	if len(filterDevs(ctx.pendingDevices)) != len(ctx.pendingDevices) {
+		ctx.pendingDevices = nil
+		ctx.pendingLocations = nil
+		ctx.pendingCmd = nil
+		ctx.pendingAt, ctx.pendingDuration = time.Time{}, 0
+	}
+	if _, found := locations[ctx.defaultLocation]; !found {
+		ctx.defaultLocation = 0
+	}
+
+	undoHistory := [][]ZWayDeviceState{}
+	for _, states := range ctx.undoHistory {
+		filtered := []ZWayDeviceState{}
+		for _, state := range states {
+			if _, found := devices[state.ID]; found {
+				filtered = append(filtered, state)
+			}
+		}
+		if len(filtered) != 0 {
+			undoHistory = append(undoHistory, filtered)
+		}
+	}
+	ctx.undoHistory = undoHistory
+}
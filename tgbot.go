@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"strconv"
 	"strings"
 
 	"gopkg.in/telegram-bot-api.v4"
@@ -29,6 +30,18 @@ func StartTgBot() {
 			updates, _ := bot.GetUpdatesChan(u)
 
 			for update := range updates {
+				if update.CallbackQuery != nil {
+					// Button of device choice is pressed
+					userName := update.CallbackQuery.From.UserName
+					bot.AnswerCallbackQuery(tgbotapi.NewCallback(update.CallbackQuery.ID, ""))
+					if _, found := enabledUsers[userName]; !found || update.CallbackQuery.Message == nil {
+						continue
+					}
+					ans, choices := runCommand(update.CallbackQuery.Data, userName)
+					bot.Send(newTgMessage(update.CallbackQuery.Message.Chat.ID, ans, choices))
+					continue
+				}
+
 				if update.Message == nil {
 					continue
 				}
@@ -41,6 +54,7 @@ func StartTgBot() {
 				}
 
 				ans := ""
+				var choices []string
 				switch update.Message.Text {
 				case "/start":
 					ans = "Привет, я умею управлять умным домом."
@@ -54,16 +68,43 @@ func StartTgBot() {
 					ans = ""
 					devs, _ := zway.Devices(false)
 					for _, dev := range devs {
-						ans += fmt.Sprintf("%s - %d\n", dev.Metrics.Title, int(dev.Metrics.Level))
+						ans += fmt.Sprintf("%s - %s\n", dev.Metrics.Title, formatDeviceLevel(dev))
+					}
+				case "/reset":
+					cmd.ResetContext(userName)
+					if err := cmd.SaveContexts(contextsFile); err != nil {
+						log.Printf("Can't save contexts: %s", err.Error())
 					}
+					ans = "Контекст сброшен"
+				case "/scenes":
+					ans = listScenes()
+				case "/tasks":
+					ans = listTasks()
 
 				default:
-					ans = runCommand(update.Message.Text, userName)
+					if strings.HasPrefix(update.Message.Text, "/cancel") {
+						ans = cancelTask(strings.TrimPrefix(update.Message.Text, "/cancel"))
+					} else {
+						ans, choices = runCommand(update.Message.Text, userName)
+					}
 				}
-				msg := tgbotapi.NewMessage(update.Message.Chat.ID, ans)
+				msg := newTgMessage(update.Message.Chat.ID, ans, choices)
 				//			msg.ReplyToMessageID = update.Message.MessageID
 				bot.Send(msg)
 			}
 		}()
 	}
 }
+
+// newTgMessage creates message with inline buttons for choices
+func newTgMessage(chatID int64, text string, choices []string) tgbotapi.MessageConfig {
+	msg := tgbotapi.NewMessage(chatID, text)
+	if len(choices) != 0 {
+		rows := [][]tgbotapi.InlineKeyboardButton{}
+		for i, choice := range choices {
+			rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(choice, strconv.Itoa(i+1))))
+		}
+		msg.ReplyMarkup = tgbotapi.NewInlineKeyboardMarkup(rows...)
+	}
+	return msg
+}
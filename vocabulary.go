@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+var commandNames = map[string]int{
+	"on":               CommandOn,
+	"off":              CommandOff,
+	"toggle":           CommandToggle,
+	"rgb":              CommandRGB,
+	"dimmer_up":        CommandDimmerUp,
+	"dimmer_down":      CommandDimmerDown,
+	"dimmer_max":       CommandDimmerMax,
+	"dimmer_level":     CommandDimmerLevel,
+	"thermostat_up":    CommandThermostatUp,
+	"thermostat_down":  CommandThermostatDown,
+	"thermostat_level": CommandThermostatLevel,
+	"undo":             CommandUndo,
+	"reset":            CommandReset,
+}
+
+// DeviceClass maps generic words, like "light", to devices of types or with tags
+type DeviceClass struct {
+	Words    []string `json:"words"`
+	DevTypes []string `json:"dev_types"`
+	Tags     []string `json:"tags"`
+}
+
+// Built-in device classes. Can be replaced by file, passed with -classes flag
+var deviceClasses = []DeviceClass{
+	{[]string{"свет", "освещение", "light", "lights", "lighting"}, []string{"switchMultilevel", "switchRGBW"}, []string{"lighting", "light"}},
+	{[]string{"отопление", "обогрев", "heating", "heater"}, []string{"thermostat"}, []string{"heating"}},
+}
+
+// CommandFileDef is entry of commands vocabulary file
+type CommandFileDef struct {
+	Words    string          `json:"words"`
+	DevTypes []string        `json:"dev_types"`
+	Command  string          `json:"command"`
+	RGB      *CommandDataRGB `json:"rgb,omitempty"`
+	Level    *int            `json:"level,omitempty"`
+}
+
+func LoadCommands(fileName string) ([]CommandDef, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	defs := []CommandFileDef{}
+	if err = json.NewDecoder(f).Decode(&defs); err != nil {
+		return nil, fmt.Errorf("Can't parse '%s': %s", fileName, err.Error())
+	}
+	if len(defs) == 0 {
+		return nil, fmt.Errorf("No commands in '%s'", fileName)
+	}
+
+	ret := make([]CommandDef, 0, len(defs))
+	for i, def := range defs {
+		c, err := def.toCommandDef()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid command #%d '%s' in '%s': %s", i+1, def.Words, fileName, err.Error())
+		}
+		ret = append(ret, c)
+	}
+	return ret, nil
+}
+
+func (def CommandFileDef) toCommandDef() (CommandDef, error) {
+	c := CommandDef{Words: def.Words, DevTypes: def.DevTypes}
+
+	if len(splitPhrase(def.Words)) == 0 {
+		return c, fmt.Errorf("No words")
+	}
+	if len(def.DevTypes) == 0 {
+		return c, fmt.Errorf("No device types")
+	}
+
+	var err error
+	c.Command, c.CmdData, err = parseCommandName(def.Command, def.RGB, def.Level)
+	return c, err
+}
+
+// parseCommandName converts command name and its data to command kind and command data
+func parseCommandName(name string, rgb *CommandDataRGB, level *int) (int, interface{}, error) {
+	command, found := commandNames[name]
+	if !found {
+		return 0, nil, fmt.Errorf("Unknown command '%s'", name)
+	}
+
+	switch command {
+	case CommandRGB:
+		if rgb == nil {
+			return command, nil, fmt.Errorf("Command '%s' requires 'rgb'", name)
+		}
+		return command, *rgb, nil
+	case CommandDimmerLevel, CommandThermostatLevel:
+		if level == nil {
+			return command, nil, fmt.Errorf("Command '%s' requires 'level'", name)
+		}
+		if command == CommandDimmerLevel && *level != clampDeviceLevel(*level) {
+			return command, nil, fmt.Errorf("Level %d is out of range %d..%d", *level, minDeviceLevel, maxDeviceLevel)
+		}
+		if command == CommandThermostatLevel && *level != clampThermostatLevel(*level) {
+			return command, nil, fmt.Errorf("Level %d is out of range %d..%d", *level, minThermostatLevel, maxThermostatLevel)
+		}
+		return command, CommandDataLevel{*level}, nil
+	}
+	return command, nil, nil
+}
+
+func LoadDeviceClasses(fileName string) ([]DeviceClass, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	classes := []DeviceClass{}
+	if err = json.NewDecoder(f).Decode(&classes); err != nil {
+		return nil, fmt.Errorf("Can't parse '%s': %s", fileName, err.Error())
+	}
+
+	for i, class := range classes {
+		if len(class.Words) == 0 {
+			return nil, fmt.Errorf("Invalid device class #%d in '%s': No words", i+1, fileName)
+		}
+		if len(class.DevTypes) == 0 && len(class.Tags) == 0 {
+			return nil, fmt.Errorf("Invalid device class #%d '%s' in '%s': No device types or tags", i+1, class.Words[0], fileName)
+		}
+	}
+	return classes, nil
+}
+
+// isMatch returns true if device has one of class types or tags
+func (class *DeviceClass) isMatch(devType string, tags []string) bool {
+	for _, t := range class.DevTypes {
+		if t == devType {
+			return true
+		}
+	}
+	for _, t := range class.Tags {
+		for _, tag := range tags {
+			if t == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
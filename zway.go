@@ -7,6 +7,7 @@ import (
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -15,6 +16,10 @@ const (
 	maxDeviceLevel  = 99
 	minDeviceLevel  = 0
 	stepDeviceLevel = 10
+
+	maxThermostatLevel  = 35
+	minThermostatLevel  = 5
+	stepThermostatLevel = 1
 )
 
 type ZWayDeviceLevel float64
@@ -40,9 +45,12 @@ type ZWayDevice struct {
 	H          int    `json:"h"`
 	ID         string `json:"id"`
 	Location   int    `json:"location"`
+	ProbeType  string `json:"probeType"`
 	Metrics    struct {
-		Title string `json:"title"`
-		Color struct {
+		Title      string `json:"title"`
+		ProbeTitle string `json:"probeTitle"`
+		ScaleTitle string `json:"scaleTitle"`
+		Color      struct {
 			R int `json:"r"`
 			G int `json:"g"`
 			B int `json:"b"`
@@ -51,11 +59,18 @@ type ZWayDevice struct {
 		RgbColors string          `json:"rgbColors"`
 	} `json:"metrics"`
 	PermanentlyHidden bool          `json:"permanently_hidden"`
-	Tags              []interface{} `json:"tags"`
+	Tags              []string      `json:"tags"`
 	Visibility        bool          `json:"visibility"`
 	UpdateTime        int           `json:"updateTime"`
 }
 
+// ZWayDeviceState is device state, which can be restored
+type ZWayDeviceState struct {
+	ID      string
+	Level   int
+	R, G, B int
+}
+
 type ZWayDevicesResp struct {
 	Data struct {
 		StructureChanged bool         `json:"structureChanged"`
@@ -85,47 +100,179 @@ type ZWayLocationsResp struct {
 	Error   interface{}    `json:"error"`
 }
 
+// Kinds of ZWay cache change events
+const (
+	ZWayDeviceAdded = iota
+	ZWayDeviceRemoved
+	ZWayDeviceUpdated
+	ZWayLocationAdded
+	ZWayLocationRemoved
+	ZWayLocationUpdated
+)
+
+// ZWayEvent is change of device or location in ZWay cache.
+// Device is updated, when its title, type, location or tags are changed, but not level
+type ZWayEvent struct {
+	Kind       int
+	DeviceID   string
+	LocationID int
+}
+
+// ZWaySession is state of ZWay session for health reporting
+type ZWaySession struct {
+	Authorized bool      `json:"authorized"`
+	AuthTime   time.Time `json:"auth_time"`
+	Reauths    int       `json:"reauths"`
+	LastError  string    `json:"last_error,omitempty"`
+}
+
 type ZWay struct {
-	baseURL   string
-	zwaySess  string
-	devices   map[string]ZWayDevice
-	locations map[int]ZWayLocation
-	lock      sync.Mutex
+	baseURL     string
+	zwaySess    string
+	login       string
+	password    string
+	session     ZWaySession
+	authLock    sync.Mutex
+	devices     map[string]ZWayDevice
+	locations   map[int]ZWayLocation
+	subscribers []func(events []ZWayEvent)
+	// Server time of last devices reload, changes since it are requested by incremental polling
+	updateTime int
+	lock       sync.Mutex
 }
 
+// Period of full reload of devices and locations, besides incremental polling
+const fullReloadPeriod = 10 * time.Minute
+
 func NewZWay(baseURL string) *ZWay {
 	return &ZWay{baseURL: baseURL, devices: make(map[string]ZWayDevice), locations: make(map[int]ZWayLocation)}
 }
 
+// Auth logins to ZWay server. Credentials are kept to login again, when session is expired
 func (zw *ZWay) Auth(name string, pass string) error {
-	authData, _ := json.Marshal(map[string]interface{}{"login": name, "password": pass})
+	zw.lock.Lock()
+	zw.login, zw.password = name, pass
+	zw.lock.Unlock()
+
+	return zw.auth()
+}
+
+func (zw *ZWay) auth() error {
+	zw.lock.Lock()
+	login := zw.login
+	authData, _ := json.Marshal(map[string]interface{}{"login": zw.login, "password": zw.password})
+	zw.lock.Unlock()
+
 	req, _ := http.NewRequest("POST", zw.baseURL+"/login", bytes.NewBuffer(authData))
 
 	authResp := ZWayAuthResp{}
 
-	err := zw.request(req, &authResp)
+	_, authorized, err := zw.send(req, &authResp)
 
-	if len(authResp.Data.Sid) == 0 {
+	if err == nil && !authorized {
+		err = fmt.Errorf("Invalid password of user '%s'", login)
+	} else if err == nil && len(authResp.Data.Sid) == 0 {
 		err = fmt.Errorf("No token in answer")
 	}
 
-	if err == nil {
-		log.Printf("Got ZWAYAuth token: %s", authResp.Data.Sid)
-		zw.zwaySess = authResp.Data.Sid
+	zw.lock.Lock()
+	defer zw.lock.Unlock()
+	if err != nil {
+		zw.session.Authorized = false
+		zw.session.LastError = err.Error()
+		return err
+	}
+	log.Printf("Got ZWAYAuth token: %s", authResp.Data.Sid)
+	zw.zwaySess = authResp.Data.Sid
+	zw.session.Authorized = true
+	zw.session.AuthTime = time.Now()
+	zw.session.LastError = ""
+	return nil
+}
+
+// reauth logins again, if session was not renewed by other request since it was used
+func (zw *ZWay) reauth(usedSess string) error {
+	zw.authLock.Lock()
+	defer zw.authLock.Unlock()
+
+	zw.lock.Lock()
+	renewed := zw.zwaySess != usedSess
+	zw.lock.Unlock()
+	if renewed {
+		return nil
 	}
-	return err
+
+	log.Printf("ZWay session is expired, login again")
+	if err := zw.auth(); err != nil {
+		return err
+	}
+	zw.lock.Lock()
+	zw.session.Reauths++
+	zw.lock.Unlock()
+	return nil
+}
+
+// Session returns state of ZWay session
+func (zw *ZWay) Session() ZWaySession {
+	zw.lock.Lock()
+	defer zw.lock.Unlock()
+	return zw.session
+}
+
+// Subscribe adds handler of changes of devices and locations. Handler is called after each reload with changes
+func (zw *ZWay) Subscribe(handler func(events []ZWayEvent)) {
+	zw.lock.Lock()
+	defer zw.lock.Unlock()
+	zw.subscribers = append(zw.subscribers, handler)
 }
 
+// StartPolling requests changes of devices periodically. Locations and devices are fully reloaded,
+// when ZWay server reports structure change, and every fullReloadPeriod
 func (zw *ZWay) StartPolling(t time.Duration) {
 	go func() {
+		lastFullReload := time.Now()
 		for {
 			time.Sleep(t)
-			zw.Devices(true)
+			fullReload := time.Now().Sub(lastFullReload) > fullReloadPeriod
+			if !fullReload {
+				structureChanged, err := zw.UpdateDevices()
+				if err != nil {
+					log.Printf("Can't poll devices: %s", err.Error())
+					continue
+				}
+				fullReload = structureChanged
+			}
+			if !fullReload {
+				continue
+			}
+			if _, err := zw.Locations(true); err != nil {
+				log.Printf("Can't poll locations: %s", err.Error())
+				continue
+			}
+			if _, err := zw.Devices(true); err != nil {
+				log.Printf("Can't poll devices: %s", err.Error())
+				continue
+			}
+			lastFullReload = time.Now()
 		}
 	}()
 }
 
+func (zw *ZWay) notify(events []ZWayEvent) {
+	if len(events) == 0 {
+		return
+	}
+	zw.lock.Lock()
+	subscribers := zw.subscribers
+	zw.lock.Unlock()
+
+	for _, handler := range subscribers {
+		handler(events)
+	}
+}
+
 func (zw *ZWay) ControlRGB(dev string, r int, g int, b int) error {
+	zw.saveDeviceColor(dev, r, g, b)
 	req, _ := http.NewRequest("GET", zw.baseURL+"/devices/"+dev+
 		"/command/exact?red="+strconv.Itoa(r)+"&green="+strconv.Itoa(g)+"&blue="+strconv.Itoa(b), nil)
 
@@ -133,6 +280,7 @@ func (zw *ZWay) ControlRGB(dev string, r int, g int, b int) error {
 }
 
 func (zw *ZWay) ControlDimmer(dev string, level int) error {
+	level = clampDeviceLevel(level)
 	zw.saveDeviceLevel(dev, level)
 	req, _ := http.NewRequest("GET", zw.baseURL+"/devices/"+dev+"/command/exact?level="+strconv.Itoa(level), nil)
 	return zw.request(req, nil)
@@ -163,6 +311,38 @@ func (zw *ZWay) ControlDimmerMax(dev string) error {
 	return zw.ControlDimmer(dev, maxDeviceLevel)
 }
 
+func (zw *ZWay) ControlThermostat(dev string, level int) error {
+	level = clampThermostatLevel(level)
+	zw.saveDeviceLevel(dev, level)
+	req, _ := http.NewRequest("GET", zw.baseURL+"/devices/"+dev+"/command/exact?level="+strconv.Itoa(level), nil)
+	return zw.request(req, nil)
+}
+
+func (zw *ZWay) ControlThermostatUp(dev string) error {
+	return zw.ControlThermostat(dev, zw.DeviceLevel(dev)+stepThermostatLevel)
+}
+
+func (zw *ZWay) ControlThermostatDown(dev string) error {
+	return zw.ControlThermostat(dev, zw.DeviceLevel(dev)-stepThermostatLevel)
+}
+
+// ControlLevel restores device level: turns device off on zero level, or sets level according to device type
+func (zw *ZWay) ControlLevel(dev string, level int) error {
+	zw.lock.Lock()
+	devType := zw.devices[dev].DeviceType
+	zw.lock.Unlock()
+
+	switch {
+	case level == 0 && devType != "thermostat":
+		return zw.ControlOff(dev)
+	case devType == "switchMultilevel":
+		return zw.ControlDimmer(dev, level)
+	case devType == "thermostat":
+		return zw.ControlThermostat(dev, level)
+	}
+	return zw.ControlOn(dev)
+}
+
 func (zw *ZWay) ControlOff(dev string) error {
 	zw.saveDeviceLevel(dev, 0)
 	req, _ := http.NewRequest("GET", zw.baseURL+"/devices/"+dev+"/command/off", nil)
@@ -171,56 +351,192 @@ func (zw *ZWay) ControlOff(dev string) error {
 
 func (zw *ZWay) Devices(forceReload bool) (ret []ZWayDevice, err error) {
 
-	devices := ZWayDevicesResp{}
-	if len(zw.devices) == 0 || forceReload {
-		req, _ := http.NewRequest("GET", zwayURL+"/devices", nil)
-		err := zw.request(req, &devices)
+	zw.lock.Lock()
+	reload := len(zw.devices) == 0 || forceReload
+	zw.lock.Unlock()
+
+	events := []ZWayEvent{}
+	if reload {
+		resp, err := zw.fetchDevices(0)
 		if err != nil {
 			return nil, err
 		}
+		devices := []ZWayDevice{}
+		for _, d := range resp.Data.Devices {
+			if isSupportedDevice(d) {
+				devices = append(devices, d)
+			}
+		}
+		zw.lock.Lock()
+		events = zw.setDevices(devices)
+		zw.updateTime = resp.Data.UpdateTime
+		zw.lock.Unlock()
 	}
 
 	zw.lock.Lock()
-	for _, d := range devices.Data.Devices {
-		if d.Visibility && !d.PermanentlyHidden &&
-			(d.DeviceType == "switchRGBW" ||
-				d.DeviceType == "switchMultilevel" ||
-				d.DeviceType == "toggleButton" ||
-				d.DeviceType == "switchBinary" ||
-				d.DeviceType == "thermostat") {
-			zw.devices[d.ID] = d
-		}
-	}
 	for _, d := range zw.devices {
 		ret = append(ret, d)
 	}
 	zw.lock.Unlock()
 
+	zw.notify(events)
 	return ret, nil
 }
 
+// UpdateDevices requests devices, changed since last reload, and merges them to cache.
+// Returns true, if ZWay server reports structure change, then devices should be fully reloaded
+func (zw *ZWay) UpdateDevices() (structureChanged bool, err error) {
+	zw.lock.Lock()
+	since := zw.updateTime
+	zw.lock.Unlock()
+
+	if since == 0 {
+		return true, nil
+	}
+
+	resp, err := zw.fetchDevices(since)
+	if err != nil {
+		return false, err
+	}
+	if resp.Data.StructureChanged {
+		log.Printf("ZWay structure is changed")
+		return true, nil
+	}
+
+	zw.lock.Lock()
+	events := zw.mergeDevices(resp.Data.Devices)
+	zw.updateTime = resp.Data.UpdateTime
+	zw.lock.Unlock()
+
+	zw.notify(events)
+	return false, nil
+}
+
+// fetchDevices requests devices, changed since server time, or all devices, if since is 0
+func (zw *ZWay) fetchDevices(since int) (*ZWayDevicesResp, error) {
+	url := zwayURL + "/devices"
+	if since != 0 {
+		url += "?since=" + strconv.Itoa(since)
+	}
+	devices := &ZWayDevicesResp{}
+	req, _ := http.NewRequest("GET", url, nil)
+	if err := zw.request(req, devices); err != nil {
+		return nil, err
+	}
+	return devices, nil
+}
+
+func isSupportedDevice(d ZWayDevice) bool {
+	return d.Visibility && !d.PermanentlyHidden &&
+		(d.DeviceType == "switchRGBW" ||
+			d.DeviceType == "switchMultilevel" ||
+			d.DeviceType == "toggleButton" ||
+			d.DeviceType == "switchBinary" ||
+			d.DeviceType == "thermostat" ||
+			d.DeviceType == "sensorMultilevel" ||
+			d.DeviceType == "sensorBinary")
+}
+
+// setDevices replaces cached devices by reloaded ones and returns changes. Must be called with lock held
+func (zw *ZWay) setDevices(devices []ZWayDevice) []ZWayEvent {
+	events := []ZWayEvent{}
+	reloaded := make(map[string]ZWayDevice)
+	for _, d := range devices {
+		reloaded[d.ID] = d
+		if old, found := zw.devices[d.ID]; !found {
+			events = append(events, ZWayEvent{ZWayDeviceAdded, d.ID, d.Location})
+		} else if isDeviceStructureChanged(old, d) {
+			events = append(events, ZWayEvent{ZWayDeviceUpdated, d.ID, d.Location})
+		}
+	}
+	for id, d := range zw.devices {
+		if _, found := reloaded[id]; !found {
+			log.Printf("Device '%s' '%s' is removed or hidden", id, d.Metrics.Title)
+			events = append(events, ZWayEvent{ZWayDeviceRemoved, id, d.Location})
+		}
+	}
+	zw.devices = reloaded
+	return events
+}
+
+// mergeDevices updates cached devices by changed ones and returns changes. Must be called with lock held
+func (zw *ZWay) mergeDevices(devices []ZWayDevice) []ZWayEvent {
+	events := []ZWayEvent{}
+	for _, d := range devices {
+		old, found := zw.devices[d.ID]
+		switch {
+		case isSupportedDevice(d) && !found:
+			events = append(events, ZWayEvent{ZWayDeviceAdded, d.ID, d.Location})
+		case isSupportedDevice(d) && isDeviceStructureChanged(old, d):
+			events = append(events, ZWayEvent{ZWayDeviceUpdated, d.ID, d.Location})
+		case !isSupportedDevice(d) && found:
+			log.Printf("Device '%s' '%s' is removed or hidden", d.ID, old.Metrics.Title)
+			events = append(events, ZWayEvent{ZWayDeviceRemoved, d.ID, old.Location})
+			delete(zw.devices, d.ID)
+			continue
+		}
+		if isSupportedDevice(d) {
+			zw.devices[d.ID] = d
+		}
+	}
+	return events
+}
+
+func isDeviceStructureChanged(old, d ZWayDevice) bool {
+	return old.DeviceType != d.DeviceType || old.Metrics.Title != d.Metrics.Title || old.Location != d.Location ||
+		strings.Join(old.Tags, ",") != strings.Join(d.Tags, ",")
+}
+
 func (zw *ZWay) Locations(forceReload bool) (ret []ZWayLocation, err error) {
 
-	locations := ZWayLocationsResp{}
-	if len(zw.locations) == 0 || forceReload {
+	zw.lock.Lock()
+	reload := len(zw.locations) == 0 || forceReload
+	zw.lock.Unlock()
+
+	events := []ZWayEvent{}
+	if reload {
+		locations := ZWayLocationsResp{}
 		req, _ := http.NewRequest("GET", zwayURL+"/locations", nil)
 		if err := zw.request(req, &locations); err != nil {
 			return nil, err
 		}
+		zw.lock.Lock()
+		events = zw.setLocations(locations.Data)
+		zw.lock.Unlock()
 	}
 
 	zw.lock.Lock()
-	for _, loc := range locations.Data {
-		zw.locations[loc.ID] = loc
-	}
 	for _, loc := range zw.locations {
 		ret = append(ret, loc)
 	}
-
 	zw.lock.Unlock()
+
+	zw.notify(events)
 	return ret, nil
 }
 
+// setLocations replaces cached locations by reloaded ones and returns changes. Must be called with lock held
+func (zw *ZWay) setLocations(locations []ZWayLocation) []ZWayEvent {
+	events := []ZWayEvent{}
+	reloaded := make(map[int]ZWayLocation)
+	for _, loc := range locations {
+		reloaded[loc.ID] = loc
+		if old, found := zw.locations[loc.ID]; !found {
+			events = append(events, ZWayEvent{ZWayLocationAdded, "", loc.ID})
+		} else if old.Title != loc.Title {
+			events = append(events, ZWayEvent{ZWayLocationUpdated, "", loc.ID})
+		}
+	}
+	for id, loc := range zw.locations {
+		if _, found := reloaded[id]; !found {
+			log.Printf("Location %d '%s' is removed", id, loc.Title)
+			events = append(events, ZWayEvent{ZWayLocationRemoved, "", id})
+		}
+	}
+	zw.locations = reloaded
+	return events
+}
+
 func (zw *ZWay) LocationTitle(id int) string {
 	zw.lock.Lock()
 	defer zw.lock.Unlock()
@@ -233,6 +549,40 @@ func (zw *ZWay) DeviceTitle(id string) string {
 	return zw.devices[id].Metrics.Title
 }
 
+func (zw *ZWay) Device(id string) (ZWayDevice, bool) {
+	zw.lock.Lock()
+	defer zw.lock.Unlock()
+	d, found := zw.devices[id]
+	return d, found
+}
+
+func (zw *ZWay) DeviceState(id string) ZWayDeviceState {
+	zw.lock.Lock()
+	defer zw.lock.Unlock()
+	d := zw.devices[id]
+	return ZWayDeviceState{id, int(d.Metrics.Level), d.Metrics.Color.R, d.Metrics.Color.G, d.Metrics.Color.B}
+}
+
+// RestoreState restores device color and level
+func (zw *ZWay) RestoreState(state ZWayDeviceState) error {
+	zw.lock.Lock()
+	d := zw.devices[state.ID]
+	zw.lock.Unlock()
+
+	if d.DeviceType == "switchRGBW" && (d.Metrics.Color.R != state.R || d.Metrics.Color.G != state.G || d.Metrics.Color.B != state.B) {
+		if err := zw.ControlRGB(state.ID, state.R, state.G, state.B); err != nil {
+			return err
+		}
+	}
+	return zw.ControlLevel(state.ID, state.Level)
+}
+
+func (zw *ZWay) DeviceLevel(id string) int {
+	zw.lock.Lock()
+	defer zw.lock.Unlock()
+	return int(zw.devices[id].Metrics.Level)
+}
+
 func (zw *ZWay) isDeviceOn(dev string) bool {
 	zw.lock.Lock()
 	d := zw.devices[dev]
@@ -241,41 +591,96 @@ func (zw *ZWay) isDeviceOn(dev string) bool {
 }
 
 func (zw *ZWay) adjustDimmerVal(dev string, adjust int) int {
-	zw.lock.Lock()
-	d := zw.devices[dev]
-	zw.lock.Unlock()
-	iVal := int(d.Metrics.Level) + adjust
-	if iVal < minDeviceLevel {
-		iVal = minDeviceLevel
+	return clampDeviceLevel(zw.DeviceLevel(dev) + adjust)
+}
+
+func clampDeviceLevel(level int) int {
+	if level < minDeviceLevel {
+		level = minDeviceLevel
 	}
-	if iVal > maxDeviceLevel {
-		iVal = maxDeviceLevel
+	if level > maxDeviceLevel {
+		level = maxDeviceLevel
 	}
-	return iVal
+	return level
+}
+
+func clampThermostatLevel(level int) int {
+	if level < minThermostatLevel {
+		level = minThermostatLevel
+	}
+	if level > maxThermostatLevel {
+		level = maxThermostatLevel
+	}
+	return level
 }
 
 func (zw *ZWay) saveDeviceLevel(dev string, level int) {
 	zw.lock.Lock()
-	d := zw.devices[dev]
-	d.Metrics.Level = ZWayDeviceLevel(level)
-	zw.devices[dev] = d
+	if d, found := zw.devices[dev]; found {
+		d.Metrics.Level = ZWayDeviceLevel(level)
+		zw.devices[dev] = d
+	}
 	zw.lock.Unlock()
 }
 
+func (zw *ZWay) saveDeviceColor(dev string, r, g, b int) {
+	zw.lock.Lock()
+	if d, found := zw.devices[dev]; found {
+		d.Metrics.Color.R, d.Metrics.Color.G, d.Metrics.Color.B = r, g, b
+		zw.devices[dev] = d
+	}
+	zw.lock.Unlock()
+}
+
+// request sends request to ZWay server. If session is expired, logins again and retries request once
 func (zw *ZWay) request(req *http.Request, dest interface{}) error {
 
-	req.Header.Add("ZWAYSession", zw.zwaySess)
+	usedSess, authorized, err := zw.send(req, dest)
+	if err != nil || authorized {
+		return err
+	}
+
+	if err = zw.reauth(usedSess); err != nil {
+		return fmt.Errorf("Can't login to ZWay server: %s", err.Error())
+	}
+
+	if req.GetBody != nil {
+		if req.Body, err = req.GetBody(); err != nil {
+			return err
+		}
+	}
+	if _, authorized, err = zw.send(req, dest); err == nil && !authorized {
+		err = fmt.Errorf("Request '%s' is not authorized", req.URL.String())
+		zw.lock.Lock()
+		zw.session.Authorized = false
+		zw.session.LastError = err.Error()
+		zw.lock.Unlock()
+	}
+	return err
+}
+
+// send sends request with current session. Returns used session and false, if session is not authorized
+func (zw *ZWay) send(req *http.Request, dest interface{}) (usedSess string, authorized bool, err error) {
+
+	zw.lock.Lock()
+	usedSess = zw.zwaySess
+	zw.lock.Unlock()
+
+	req.Header.Set("ZWAYSession", usedSess)
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Println(err)
-		return err
+		return usedSess, false, err
 	}
 	defer resp.Body.Close()
 	log.Printf("ZWAYRequest: '%s' -> %d", req.URL.String(), resp.StatusCode)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return usedSess, false, nil
+	}
 	if dest == nil {
-		return nil
+		return usedSess, true, nil
 	}
 	dec := json.NewDecoder(resp.Body)
-	return dec.Decode(&dest)
+	return usedSess, true, dec.Decode(&dest)
 }